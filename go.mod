@@ -9,6 +9,8 @@ require (
 	github.com/juju/errgo v0.0.0-20140925100237-08cceb5d0b53
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/orcaman/writerseeker v0.0.0-20180723184025-774071c66cec
-	golang.org/x/crypto v0.0.0-20190506204251-e1dfcc566284
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
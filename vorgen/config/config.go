@@ -2,10 +2,13 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 
 	"github.com/juju/errgo"
 )
@@ -24,9 +27,45 @@ type Config struct {
 	StartMessageReply string `json:"start_message_reply"`
 	// What the robot should say if the user did not say StartMessageReply
 	StartMessageBadReply string `json:"start_message_bad_reply"`
+	// Identifies the consent text, StartMessage, e.g. "2" or "2020-01". Change it
+	// whenever the text changes, vorserve stores it with every recording so that
+	// recordings made under an older text can be found.
+	ConsentVersion string `json:"consent_version"`
+	// Optional message read once the user has agreed, asking them to state their
+	// consent again, e.g. "After the beep, please say your name and that you agree".
+	// The answer is recorded and kept by vorserve as evidence of the consent. Leave
+	// empty to only keep the transcribed answer to StartMessage.
+	ConsentRecordMessage string `json:"consent_record_message"`
 	// Message that should be played at the end of the questions, when the user
 	// has replied as desired.
 	ThanksMessage string `json:"thanks_message"`
+	// Message read after ThanksMessage telling the user how many calls have been
+	// made, {session}, {total} and {remaining} are replaced by the numbers returned
+	// from vorserve. Leave empty to not read it.
+	SessionMessage string `json:"session_message"`
+	// Message read after SessionMessage giving the reference code of the recording,
+	// {code} is replaced by the code returned from vorserve, digit by digit. The caller
+	// can use it to have their recordings deleted. Leave empty to not read it.
+	CodeMessage string `json:"code_message"`
+	// Optional branch letting callers delete their recordings, reached by saying
+	// DeletionKeyword or pressing DeletionDigit when asked StartMessage. Leave both
+	// empty to not generate it.
+	DeletionKeyword string `json:"deletion_keyword"`
+	DeletionDigit   string `json:"deletion_digit"`
+	// URL of the vorserve erasure endpoint, by default Webhook followed by erasure,
+	// and the -erasure-token vorserve is started with.
+	DeletionWebhook string `json:"deletion_webhook"`
+	DeletionToken   string `json:"deletion_token"`
+	// Asks for the reference code, keyed in followed by #, or just # to delete the
+	// recordings made from the phone calling.
+	DeletionMessage string `json:"deletion_message"`
+	// Asks the caller to confirm by saying StartMessageReply or pressing 1.
+	DeletionConfirmMessage string `json:"deletion_confirm_message"`
+	// Read when the recordings are deleted, {deleted} is replaced by their number.
+	DeletionDoneMessage string `json:"deletion_done_message"`
+	// Read when nothing was deleted, the deletion was not confirmed, the code was
+	// not known or vorserve failed.
+	DeletionFailedMessage string `json:"deletion_failed_message"`
 	// How long a total recording is desired, the robot will keep asking questions
 	// (provided enough are defined) until a recording of this length has been achieved
 	DesiredTime int `json:"desired_time"`
@@ -51,15 +90,22 @@ type Thread []string
 // // Default returns an example config that may be used as a reference.
 // func Default() Config {
 // 	return Config{
-// 		Lang:                 "en-US",
-// 		StartMessage:         "Thank you for helping us. If you agree to us storing and using this recording for training of voice models pleas say Yes.",
-// 		StartMessageReply:    "yes",
-// 		StartMessageBadReply: "Since you did not agree to the terms there is nothing you can help us with, thanks anyway.",
-// 		ThanksMessage:        "Thanks for calling, please remember to make 3 calls from different environments but the same phone",
-// 		DesiredTime:          180,
-// 		Webhook:              "https://example.com/api/callback",
-// 		SilenceTimeout:       2,
-// 		NumberVariations:     10,
+// 		Lang:                   "en-US",
+// 		StartMessage:           "Thank you for helping us. If you agree to us storing and using this recording for training of voice models pleas say Yes.",
+// 		StartMessageReply:      "yes",
+// 		StartMessageBadReply:   "Since you did not agree to the terms there is nothing you can help us with, thanks anyway.",
+// 		ConsentVersion:         "1",
+// 		ThanksMessage:          "Thanks for calling, please remember to make 3 calls from different environments but the same phone",
+// 		SessionMessage:         "This was call {session} of {total}.",
+// 		CodeMessage:            "Your reference code is {code}. Again, {code}.",
+// 		DeletionMessage:        "Key in your reference code followed by hash, or press hash to delete the recordings made from this phone number.",
+// 		DeletionConfirmMessage: "Say yes or press 1 to confirm that the recordings should be deleted.",
+// 		DeletionDoneMessage:    "{deleted} recordings were deleted. Thanks for calling.",
+// 		DeletionFailedMessage:  "No recordings were deleted. Thanks for calling.",
+// 		DesiredTime:            180,
+// 		Webhook:                "https://example.com/api/callback",
+// 		SilenceTimeout:         2,
+// 		NumberVariations:       10,
 // 		Threads: []Thread{
 // 			Thread{"A thread is a series of questions.", "That will always be asked in sequence.", "The order between different threads will be randomized though."},
 // 			Thread{"Do you like cats or dogs the most?", "Why is that?"},
@@ -78,15 +124,22 @@ type Thread []string
 // NORWEGIAN Default returns an example config that may be used as a reference.
 func Default() Config {
 	return Config{
-		Lang:                 "no-NB",
-		StartMessage:         "Takk for at du vil bidra. Samtykker du til at vi bruker opptaket fra din samtale til å trene og validere en modell for stemmeidentifikasjon?",
-		StartMessageReply:    "ja",
-		StartMessageBadReply: "Det er påkrevd at du samtykker for at vi skal kunne gjøre et opptak av din samtale. Takk for at du ringte.",
-		ThanksMessage:        "Takk for at du ringer. For å kunne teste systemet best mulig trenger vi opptak av tre samtaler fra deg, helst fra tre ulike steder.",
-		DesiredTime:          60,
-		Webhook:              "https://vorno.newtechlab.wtf/",
-		SilenceTimeout:       4,
-		NumberVariations:     10,
+		Lang:                   "no-NB",
+		StartMessage:           "Takk for at du vil bidra. Samtykker du til at vi bruker opptaket fra din samtale til å trene og validere en modell for stemmeidentifikasjon?",
+		StartMessageReply:      "ja",
+		StartMessageBadReply:   "Det er påkrevd at du samtykker for at vi skal kunne gjøre et opptak av din samtale. Takk for at du ringte.",
+		ConsentVersion:         "1",
+		ThanksMessage:          "Takk for at du ringer. For å kunne teste systemet best mulig trenger vi opptak av tre samtaler fra deg, helst fra tre ulike steder.",
+		SessionMessage:         "Dette var samtale {session} av {total}.",
+		CodeMessage:            "Din referansekode er {code}. Jeg gjentar, {code}.",
+		DeletionMessage:        "Tast inn referansekoden din etterfulgt av firkant, eller trykk firkant for å slette opptakene fra telefonnummeret du ringer fra.",
+		DeletionConfirmMessage: "Si ja eller trykk 1 for å bekrefte at opptakene skal slettes.",
+		DeletionDoneMessage:    "{deleted} opptak er slettet. Takk for at du ringte.",
+		DeletionFailedMessage:  "Ingen opptak ble slettet. Takk for at du ringte.",
+		DesiredTime:            60,
+		Webhook:                "https://vorno.newtechlab.wtf/",
+		SilenceTimeout:         4,
+		NumberVariations:       10,
 		Threads: []Thread{
 			Thread{"A thread is a series of questions.", "That will always be asked in sequence.", "The order between different threads will be randomized though."},
 			Thread{"Hva gjorde du i sommerferien?", "Liker du best sommer eller vinter, og hvorfor det?"},
@@ -129,6 +182,9 @@ func (c Config) validate() error {
 	if c.StartMessageReply == "" {
 		return errgo.New("'start_message_reply' must be specified as the expression the user must say to indicate agreement to the terms/start_message. Typically YES in the given language.")
 	}
+	if c.DeletionEnabled() && c.DeletionToken == "" {
+		return errgo.New("'deletion_token' must be set to the -erasure-token of vorserve when 'deletion_keyword' or 'deletion_digit' is set")
+	}
 	if c.Threads == nil || len(c.Threads) == 0 {
 		return errgo.New("'threads' must specified as an array of array of strings")
 	}
@@ -140,6 +196,26 @@ func (c Config) validate() error {
 	return nil
 }
 
+// ConsentTextHash returns the hex encoded SHA-256 of Lang and StartMessage
+// separated by a newline, identifying the text the caller consented to.
+func (c Config) ConsentTextHash() string {
+	sum := sha256.Sum256([]byte(c.Lang + "\n" + c.StartMessage))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeletionEnabled reports whether the deletion branch is generated.
+func (c Config) DeletionEnabled() bool {
+	return c.DeletionKeyword != "" || c.DeletionDigit != ""
+}
+
+// ErasureURL returns the URL of the vorserve erasure endpoint.
+func (c Config) ErasureURL() string {
+	if c.DeletionWebhook != "" {
+		return c.DeletionWebhook
+	}
+	return strings.TrimSuffix(c.Webhook, "/") + "/erasure"
+}
+
 func (c Config) checkLang() error {
 	for _, l := range languages {
 		if l == c.Lang {
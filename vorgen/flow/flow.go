@@ -1,4 +1,5 @@
-package main
+// Package flow generates the Twillio Studio flow of a vorgen config.
+package flow
 
 import (
 	"crypto/rand"
@@ -11,7 +12,8 @@ import (
 	"github.com/newtechlab/vor/vorgen/twillio"
 )
 
-func generateTwillioProject(c config.Config) (p *twillio.Project) {
+// Generate returns the Studio project asking the questions of c.
+func Generate(c config.Config) (p *twillio.Project) {
 	p = &twillio.Project{
 		Description: "Project generated by vorgen",
 		States:      []twillio.State{},
@@ -52,11 +54,12 @@ func generateSequence(p *twillio.Project, c config.Config, ox, oy int, no int) s
 				vals = append(vals, fmt.Sprintf("\"{{widgets.ans_%v_%v.RecordingUrl}}\"", no, j))
 			}
 
-			s1 := createPlay(c, 2060+ox, 710+300*le+oy, fmt.Sprintf("play_%v_%v", no, le), c.ThanksMessage, nil)
+			webhook := fmt.Sprintf("send_data_%v_%v", no, le)
+			s1 := createPlay(c, 2060+ox, 710+300*le+oy, fmt.Sprintf("play_%v_%v", no, le), thanksMessage(c, webhook), nil)
 			p.Add(s1)
 
 			s2 := createWebhook(c, 1700+ox, 710+300*le+oy,
-				fmt.Sprintf("send_data_%v_%v", no, le), "["+strings.Join(vals, ",")+"]",
+				webhook, "["+strings.Join(vals, ",")+"]", no,
 				&s1.Sid,
 			)
 			p.Add(s2)
@@ -87,6 +90,27 @@ func generateSequence(p *twillio.Project, c config.Config, ox, oy int, no int) s
 	return nextFirst
 }
 
+// the final message, includes the session count and reference code
+// returned by the webhook if configured.
+func thanksMessage(c config.Config, webhook string) string {
+	field := func(name string) string {
+		return "{{widgets." + webhook + ".parsed." + name + "}}"
+	}
+	r := strings.NewReplacer(
+		"{session}", field("session"),
+		"{total}", field("total"),
+		"{remaining}", field("remaining"),
+		"{code}", field("code"),
+	)
+	msg := c.ThanksMessage
+	for _, m := range []string{c.SessionMessage, c.CodeMessage} {
+		if m != "" {
+			msg += " " + r.Replace(m)
+		}
+	}
+	return msg
+}
+
 func generateStaticPart(p *twillio.Project, c config.Config, next []string) {
 	sa := createPlay(c, -380, 490, "abort", c.StartMessageBadReply, nil)
 	p.Add(sa)
@@ -110,32 +134,138 @@ func generateStaticPart(p *twillio.Project, c config.Config, next []string) {
 	s3 := createSetVariables(c, 0, 490, "set_variables_00", "0", &s2.Sid)
 	p.Add(s3)
 
-	s4 := createSplit(c, -280, 260, "split_1", "{{widgets.gather_1.SpeechResult}}", sa.Sid, "contains", c.StartMessageReply, s3.Sid)
+	consent := s3.Sid
+	if c.ConsentRecordMessage != "" {
+		sr := createRecord(c, 400, 490, "record_consent", &s3.Sid)
+		p.Add(sr)
+
+		sm := createPlay(c, 400, 260, "consent_message", c.ConsentRecordMessage, &sr.Sid)
+		p.Add(sm)
+		consent = sm.Sid
+	}
+
+	// when the consent was given, sent with the recording as evidence
+	sc := createSetVariables(c, 40, 260, "set_consent", "{{ 'now' | date: '%s' }}", &consent)
+	p.Add(sc)
+
+	s4 := createSplit(c, -280, 260, "split_1", "{{widgets.gather_1.SpeechResult}}", sa.Sid, "contains", c.StartMessageReply, sc.Sid)
 	p.Add(s4)
 
-	s5 := createGather(c, -480, 40, "gather_1", &s4.Sid)
+	answered := s4.Sid
+	if c.DeletionEnabled() {
+		answered = generateDeletion(p, c, s4.Sid)
+	}
+
+	s5 := createGather(c, -480, 40, "gather_1", c.StartMessage, "yes,no", &answered)
 	p.Add(s5)
 
 	s6 := createInitialState(c, -740, -140, &s5.Sid)
 	p.Add(s6)
 }
 
-func createWebhook(c config.Config, x, y int, name, value string, next *string) twillio.State {
+// the branch letting the caller delete their recordings, taken if the answer
+// to the start message is the deletion keyword or digit, otherwise the flow
+// continues with next. Returns the first state.
+func generateDeletion(p *twillio.Project, c config.Config, next string) string {
+	sf := createPlay(c, -1900, 1180, "deletion_failed", c.DeletionFailedMessage, nil)
+	p.Add(sf)
+
+	sd := createPlay(c, -1540, 1180, "deletion_done", strings.Replace(c.DeletionDoneMessage, "{deleted}", "{{widgets.erase.parsed.deleted}}", -1), nil)
+	p.Add(sd)
+
+	se := createErasureWebhook(c, -1540, 940, "erase", &sd.Sid, &sf.Sid)
+	p.Add(se)
+
+	s1 := createSplit(c, -1900, 700, "split_confirm_digits", "{{widgets.gather_confirm.Digits}}", sf.Sid, "equal_to", "1", se.Sid)
+	p.Add(s1)
+
+	s2 := createSplit(c, -1540, 700, "split_confirm", "{{widgets.gather_confirm.SpeechResult}}", s1.Sid, "contains", c.StartMessageReply, se.Sid)
+	p.Add(s2)
+
+	s3 := createGather(c, -1540, 490, "gather_confirm", c.DeletionConfirmMessage, c.StartMessageReply, &s2.Sid)
+	p.Add(s3)
+
+	s4 := createGather(c, -1540, 260, "gather_code", c.DeletionMessage, "", &s3.Sid)
+	p.Add(s4)
+
+	// speech and key presses are different inputs, so they are split on in turn
+	first := next
+	if c.DeletionDigit != "" {
+		s5 := createSplit(c, -1180, 260, "split_delete_digits", "{{widgets.gather_1.Digits}}", first, "equal_to", c.DeletionDigit, s4.Sid)
+		p.Add(s5)
+		first = s5.Sid
+	}
+	if c.DeletionKeyword != "" {
+		s6 := createSplit(c, -820, 260, "split_delete", "{{widgets.gather_1.SpeechResult}}", first, "contains", c.DeletionKeyword, s4.Sid)
+		p.Add(s6)
+		first = s6.Sid
+	}
+	return first
+}
+
+// the code is sent as both the digits and speech, vorserve ignores anything
+// but digits and, if there are none, deletes the recordings of the caller
+func createErasureWebhook(c config.Config, x, y int, name string, next, failed *string) twillio.State {
 	p := createProps(x, y,
 		"method", "POST",
-		"url", c.Webhook,
+		"url", c.ErasureURL(),
 		"body", nil,
 		"timeout", nil,
-		"parameters", []map[string]interface{}{{
-			"key":   "urls",
-			"value": value,
-			"index": 0,
-		},
+		"parameters", []map[string]interface{}{
 			{
 				"key":   "phone",
 				"value": "{{trigger.call.From}}",
 			},
+			{
+				"key":   "call_sid",
+				"value": "{{trigger.call.CallSid}}",
+			},
+			{
+				"key":   "code",
+				"value": "{{widgets.gather_code.Digits}} {{widgets.gather_code.SpeechResult}}",
+			},
+			{
+				"key":   "token",
+				"value": c.DeletionToken,
+			},
+		},
+		"save_response_as", nil,
+		"content_type", "application/x-www-form-urlencoded;charset=utf-8",
+	)
+	ts := []twillio.Transition{
+		createTransition("success", next, []twillio.Condition{}),
+		createTransition("failed", failed, []twillio.Condition{}),
+	}
+	return createState("Webhook", name, p, ts)
+}
+
+func createWebhook(c config.Config, x, y int, name, value string, variation int, next *string) twillio.State {
+	params := []map[string]interface{}{
+		{
+			"key":   "urls",
+			"value": value,
+			"index": 0,
 		},
+		{
+			"key":   "phone",
+			"value": "{{trigger.call.From}}",
+		},
+		{
+			"key":   "call_sid",
+			"value": "{{trigger.call.CallSid}}",
+		},
+		{
+			"key":   "variation",
+			"value": fmt.Sprint(variation),
+		},
+	}
+	params = append(params, consentParams(c)...)
+	p := createProps(x, y,
+		"method", "POST",
+		"url", c.Webhook,
+		"body", nil,
+		"timeout", nil,
+		"parameters", params,
 		"save_response_as", nil,
 		"content_type", "application/x-www-form-urlencoded;charset=utf-8",
 	)
@@ -146,6 +276,44 @@ func createWebhook(c config.Config, x, y int, name, value string, next *string)
 	return createState("Webhook", name, p, ts)
 }
 
+// the evidence of the consent given at the start of the call, the hash
+// identifies the exact text asked
+func consentParams(c config.Config) []map[string]interface{} {
+	params := []map[string]interface{}{
+		{
+			"key":   "consent_version",
+			"value": c.ConsentVersion,
+		},
+		{
+			"key":   "consent_speech",
+			"value": "{{widgets.gather_1.SpeechResult}}",
+		},
+		{
+			"key":   "consent_confidence",
+			"value": "{{widgets.gather_1.Confidence}}",
+		},
+		{
+			"key":   "consent_time",
+			"value": "{{widgets.set_consent.time}}",
+		},
+		{
+			"key":   "consent_text_hash",
+			"value": c.ConsentTextHash(),
+		},
+		{
+			"key":   "consent_lang",
+			"value": c.Lang,
+		},
+	}
+	if c.ConsentRecordMessage != "" {
+		params = append(params, map[string]interface{}{
+			"key":   "consent_url",
+			"value": "{{widgets.record_consent.RecordingUrl}}",
+		})
+	}
+	return params
+}
+
 func createSplit(c config.Config, x, y int, name, input string, noMatchNext string, strs ...string) twillio.State {
 
 	if len(strs)%3 != 0 {
@@ -197,19 +365,19 @@ func createSetVariables(c config.Config, x, y int, name, value string, next *str
 	return createState("SetVariables", name, p, ts)
 }
 
-func createGather(c config.Config, x, y int, name string, next *string) twillio.State {
+func createGather(c config.Config, x, y int, name, msg, hints string, next *string) twillio.State {
 	p := createProps(x, y,
 		"timeout", 5,
 		"finish_on_key", "#",
 		"stop_gather", true,
 		"save_response_as", nil,
-		"say", c.StartMessage,
+		"say", msg,
 		"play", nil,
 		"voice", "default",
 		"language", c.Lang,
 		"loop", 1,
 		"gather_language", c.Lang,
-		"hints", "yes,no",
+		"hints", hints,
 	)
 	ts := []twillio.Transition{
 		createTransition("speech", next,
@@ -314,6 +482,11 @@ func createProps(x, y int, args ...interface{}) twillio.Properties {
 	return p
 }
 
+// CallSid returns a random call sid, e.g. for a simulated call.
+func CallSid() string {
+	return "CA" + strings.ToLower(generateSid()[2:])
+}
+
 func generateSid() string {
 	buf := make([]byte, 16)
 	n, err := rand.Read(buf)
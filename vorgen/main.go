@@ -7,20 +7,37 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/newtechlab/vor/vorgen/config"
+	"github.com/newtechlab/vor/vorgen/flow"
+	"github.com/newtechlab/vor/vorgen/twillio"
 )
 
 var (
 	fConfig     string
 	fDumpConfig bool
 	fHelp       bool
+
+	fSimulate          bool
+	fFrom              string
+	fCallSid           string
+	fInput             string
+	fRecordingURL      string
+	fRecordingDuration int
 )
 
 func init() {
 	flag.StringVar(&fConfig, "config", "./config.json", "path to config file")
 	flag.BoolVar(&fHelp, "h", false, "show this info")
 	flag.BoolVar(&fDumpConfig, "dump", false, "dump a sample config file")
+
+	flag.BoolVar(&fSimulate, "simulate", false, "run a call through the generated flow instead of printing it, sending the webhook requests Studio would")
+	flag.StringVar(&fFrom, "from", "+4799999999", "phone number of the simulated call")
+	flag.StringVar(&fCallSid, "call-sid", "", "call sid of the simulated call, random if empty")
+	flag.StringVar(&fInput, "input", "", "answers of the simulated caller, separated by ;, e.g. say:ja;dtmf:123#")
+	flag.StringVar(&fRecordingURL, "recording-url", "", "url of the recording returned by every record of the simulated call")
+	flag.IntVar(&fRecordingDuration, "recording-duration", 10, "duration in seconds of every recording of the simulated call")
 }
 
 func main() {
@@ -34,10 +51,44 @@ func main() {
 	}
 
 	config := loadConfig()
-	project := generateTwillioProject(config)
+	project := flow.Generate(config)
+	if fSimulate {
+		simulate(project)
+		return
+	}
 	dumpTwillio(project)
 }
 
+// run the flow as imported into Studio
+func simulate(p *twillio.Project) {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		log.Fatalln("error encoding twillio JSON: ", err)
+	}
+	imported := &twillio.Project{}
+	if err := json.Unmarshal(buf, imported); err != nil {
+		log.Fatalln("error decoding twillio JSON: ", err)
+	}
+	c := twillio.Call{
+		From:              fFrom,
+		CallSid:           fCallSid,
+		RecordingURL:      fRecordingURL,
+		RecordingDuration: fRecordingDuration,
+		Out:               os.Stdout,
+	}
+	if c.CallSid == "" {
+		c.CallSid = flow.CallSid()
+	}
+	for _, in := range strings.Split(fInput, ";") {
+		if in = strings.TrimSpace(in); in != "" {
+			c.Inputs = append(c.Inputs, in)
+		}
+	}
+	if err := imported.Run(c); err != nil {
+		log.Fatalln("error simulating call: ", err)
+	}
+}
+
 func showHelp() {
 	fmt.Println("vorgen: generate Twiliio project for voice recording")
 	fmt.Println("")
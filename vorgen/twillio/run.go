@@ -0,0 +1,389 @@
+package twillio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// A Call is a simulated incoming call.
+type Call struct {
+	From    string
+	CallSid string
+	// Inputs answer the Gather widgets in turn, "say:<speech>" or
+	// "dtmf:<digits>", the rest time out. Speech is recognized with a
+	// confidence of 1 unless given as "say:<speech>@<confidence>".
+	Inputs []string
+	// RecordingURL and RecordingDuration are the result of every Record
+	RecordingURL      string
+	RecordingDuration int
+	// Out is where the flow is printed
+	Out io.Writer
+}
+
+// Run walks the flow of the project as Studio would for the call, sending
+// the same webhook requests. Only the widgets and liquid generated by
+// vorgen are supported.
+func (p *Project) Run(c Call) error {
+	r := &run{
+		c: c,
+		vars: map[string]interface{}{
+			"trigger": map[string]interface{}{
+				"call": map[string]interface{}{
+					"From":    c.From,
+					"CallSid": c.CallSid,
+				},
+			},
+		},
+		widgets: map[string]interface{}{},
+	}
+	r.vars["widgets"] = r.widgets
+
+	var s *State
+	for i := range p.States {
+		if p.States[i].Type == "InitialState" {
+			s = &p.States[i]
+		}
+	}
+	if s == nil {
+		return errgo.New("no initial state")
+	}
+	next := s.next("incomingCall")
+	for steps := 0; next != nil; steps++ {
+		if steps > 1000 {
+			return errgo.New("the flow does not end")
+		}
+		if s = p.find(*next); s == nil {
+			return errgo.New("no state " + *next)
+		}
+		var err error
+		if next, err = r.step(s); err != nil {
+			return errgo.Notef(err, "error in %v", s.Name)
+		}
+	}
+	fmt.Fprintln(c.Out, "hangup")
+	return nil
+}
+
+type run struct {
+	c       Call
+	vars    map[string]interface{}
+	widgets map[string]interface{}
+}
+
+func (p *Project) find(sid string) *State {
+	for i := range p.States {
+		if p.States[i].Sid == sid || p.States[i].Name == sid {
+			return &p.States[i]
+		}
+	}
+	return nil
+}
+
+// the next state on the event, nil to hang up
+func (s *State) next(event string) *string {
+	for _, t := range s.Transitions {
+		if string(t.Event) == event {
+			return t.Next
+		}
+	}
+	return nil
+}
+
+// run a widget, returning the next state
+func (r *run) step(s *State) (*string, error) {
+	event, err := r.widget(s)
+	if err != nil || event != "match" {
+		return s.next(event), err
+	}
+	// the conditions of the match transitions are tried in order
+	in := r.render(stringProp(s, "input"))
+	for _, t := range s.Transitions {
+		if t.Event != "match" {
+			continue
+		}
+		for _, cond := range t.Conditions {
+			typ, _ := cond["type"].(string)
+			value, _ := cond["value"].(string)
+			ok, err := match(typ, in, r.render(value))
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			if ok {
+				return t.Next, nil
+			}
+		}
+	}
+	return s.next("noMatch"), nil
+}
+
+func stringProp(s *State, key string) string {
+	v, _ := s.Properties[key].(string)
+	return v
+}
+
+// run a widget, returning the event it ends with
+func (r *run) widget(s *State) (string, error) {
+	w := map[string]interface{}{}
+	r.widgets[s.Name] = w
+	str := func(key string) string {
+		return r.render(stringProp(s, key))
+	}
+
+	switch s.Type {
+	case "SayPlay":
+		fmt.Fprintf(r.c.Out, "%v says: %v\n", s.Name, str("say"))
+		return "audioComplete", nil
+
+	case "Gather":
+		fmt.Fprintf(r.c.Out, "%v says: %v\n", s.Name, str("say"))
+		if len(r.c.Inputs) == 0 {
+			fmt.Fprintln(r.c.Out, "  timeout")
+			return "timeout", nil
+		}
+		in := r.c.Inputs[0]
+		r.c.Inputs = r.c.Inputs[1:]
+		fmt.Fprintf(r.c.Out, "  %v\n", in)
+		switch {
+		case strings.HasPrefix(in, "say:"):
+			speech, confidence := strings.TrimPrefix(in, "say:"), "1"
+			if i := strings.LastIndex(speech, "@"); i >= 0 {
+				speech, confidence = speech[:i], speech[i+1:]
+			}
+			w["SpeechResult"] = speech
+			w["Confidence"] = confidence
+			return "speech", nil
+		case strings.HasPrefix(in, "dtmf:"):
+			w["Digits"] = strings.TrimSuffix(strings.TrimPrefix(in, "dtmf:"), "#")
+			return "keypress", nil
+		}
+		return "", errgo.New("inputs must start with say: or dtmf:, got " + in)
+
+	case "Record":
+		w["RecordingUrl"] = r.c.RecordingURL
+		w["RecordingDuration"] = strconv.Itoa(r.c.RecordingDuration)
+		fmt.Fprintf(r.c.Out, "%v records %vs\n", s.Name, r.c.RecordingDuration)
+		return "recordingComplete", nil
+
+	case "SetVariables":
+		for _, v := range list(s.Properties["variables"]) {
+			key, _ := v["key"].(string)
+			value, _ := v["value"].(string)
+			w[key] = r.render(value)
+		}
+		return "next", nil
+
+	case "Branch":
+		return "match", nil
+
+	case "Webhook":
+		return r.webhook(s, w)
+	}
+	return "", errgo.New("unsupported widget " + s.Type)
+}
+
+func match(typ, in, value string) (bool, error) {
+	switch typ {
+	case "contains":
+		return strings.Contains(strings.ToLower(in), strings.ToLower(value)), nil
+	case "equal_to":
+		return strings.EqualFold(in, value), nil
+	case "greater_than", "less_than":
+		a, err1 := strconv.ParseFloat(in, 64)
+		b, err2 := strconv.ParseFloat(value, 64)
+		if err1 != nil || err2 != nil {
+			return false, nil
+		}
+		if typ == "greater_than" {
+			return a > b, nil
+		}
+		return a < b, nil
+	}
+	return false, errgo.New("unsupported condition " + typ)
+}
+
+func (r *run) webhook(s *State, w map[string]interface{}) (string, error) {
+	method, u := stringProp(s, "method"), stringProp(s, "url")
+	form := url.Values{}
+	for _, p := range list(s.Properties["parameters"]) {
+		key, _ := p["key"].(string)
+		value, _ := p["value"].(string)
+		form.Add(key, r.render(value))
+	}
+	fmt.Fprintf(r.c.Out, "%v %v %v\n", s.Name, method, u)
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(r.c.Out, "  %v=%v\n", k, form.Get(k))
+	}
+	req, err := http.NewRequest(method, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(r.c.Out, "  failed: %v\n", err)
+		return "failed", nil
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	fmt.Fprintf(r.c.Out, "  %v %v\n", resp.StatusCode, strings.TrimSpace(string(body)))
+	w["status_code"] = strconv.Itoa(resp.StatusCode)
+	w["body"] = string(body)
+	if resp.StatusCode/100 != 2 {
+		return "failed", nil
+	}
+	parsed := map[string]interface{}{}
+	if json.Unmarshal(body, &parsed) == nil {
+		w["parsed"] = parsed
+	}
+	return "success", nil
+}
+
+// the properties holding lists of objects, as generated or read from JSON
+func list(v interface{}) []map[string]interface{} {
+	switch l := v.(type) {
+	case []map[string]interface{}:
+		return l
+	case []interface{}:
+		res := []map[string]interface{}{}
+		for _, e := range l {
+			if m, ok := e.(map[string]interface{}); ok {
+				res = append(res, m)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+var liquid = regexp.MustCompile(`{{(.*?)}}`)
+
+// render the liquid in s, supporting variables and the plus, replace, slice,
+// modulo and date filters
+func (r *run) render(s string) string {
+	return liquid.ReplaceAllStringFunc(s, func(m string) string {
+		parts := strings.Split(m[2:len(m)-2], "|")
+		v := r.value(parts[0])
+		for _, f := range parts[1:] {
+			name, args := strings.TrimSpace(f), []string{}
+			if i := strings.Index(name, ":"); i >= 0 {
+				for _, a := range strings.Split(name[i+1:], ",") {
+					args = append(args, r.value(a))
+				}
+				name = name[:i]
+			}
+			v = filter(name, v, args)
+		}
+		return v
+	})
+}
+
+// a quoted string, a number or a variable
+func (r *run) value(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return s
+	}
+	var v interface{} = r.vars
+	for _, k := range strings.Split(s, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[k]
+	}
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func filter(name, v string, args []string) string {
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	num := func(s string) float64 {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	switch name {
+	case "plus":
+		return strconv.FormatFloat(num(v)+num(arg(0)), 'f', -1, 64)
+	case "replace":
+		return strings.Replace(v, arg(0), arg(1), -1)
+	case "modulo":
+		n := int(num(arg(0)))
+		if n == 0 {
+			return v
+		}
+		return strconv.Itoa(int(num(v)) % n)
+	case "date":
+		t := time.Now()
+		if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+			t = time.Unix(s, 0)
+		} else if v != "now" {
+			return v
+		}
+		return strftime(t, arg(0))
+	case "slice":
+		rs := []rune(v)
+		start, n := int(num(arg(0))), 1
+		if len(args) > 1 {
+			n = int(num(arg(1)))
+		}
+		if start < 0 {
+			start += len(rs)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start > len(rs) {
+			start = len(rs)
+		}
+		end := start + n
+		if end > len(rs) {
+			end = len(rs)
+		}
+		return string(rs[start:end])
+	}
+	return v
+}
+
+// the conversions of strftime used in liquid dates
+func strftime(t time.Time, format string) string {
+	return strings.NewReplacer(
+		"%s", strconv.FormatInt(t.Unix(), 10),
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+		"%z", t.Format("-0700"),
+		"%%", "%",
+	).Replace(format)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+	"github.com/newtechlab/vor/vorserve/metrics"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// the admin api is served on a separate listener, that should not be
+// reachable from the internet, since it exposes details of all recordings.
+// The health checks have their own listener, see newHealthMux.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recordings", recordingsHandler)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+// list recordings matching the filters given as query parameters, the reply
+// also summarizes all matching recordings, e.g. to get hours and speakers of
+// a week use /recordings?from=2019-11-18&to=2019-11-25&limit=0
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := globalIndex.Find(q)
+	if err != nil {
+		logging.Error("error querying index", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func parseQuery(v url.Values) (q index.Query, err error) {
+	q = index.Query{
+		Speaker: v.Get("speaker"),
+		CallSID: v.Get("call_sid"),
+		Code:    normalizeCode(v.Get("code")),
+		Limit:   defaultLimit,
+	}
+	if s := v.Get("code"); s != "" && len(q.Code) != codeDigits {
+		return q, errgo.New("bad code: " + s)
+	}
+	// given but empty finds recordings without a consent version
+	if vs, ok := v["consent_version"]; ok {
+		q.ConsentVersion = &vs[0]
+	}
+	if s := v.Get("variation"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return q, errgo.New("bad variation: " + s)
+		}
+		q.Variation = &n
+	}
+	if q.From, err = parseTime(v.Get("from")); err != nil {
+		return q, errgo.Mask(err)
+	}
+	if q.To, err = parseTime(v.Get("to")); err != nil {
+		return q, errgo.Mask(err)
+	}
+	if s := v.Get("min_duration"); s != "" {
+		if q.MinDuration, err = strconv.ParseFloat(s, 64); err != nil {
+			return q, errgo.New("bad min_duration: " + s)
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			return q, errgo.New("bad offset: " + s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 || q.Limit > maxLimit {
+			return q, errgo.New("bad limit, must be between 0 and " + strconv.Itoa(maxLimit) + ": " + s)
+		}
+	}
+	return q, nil
+}
+
+// accepts both dates and RFC3339 timestamps, dates are in UTC
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, errgo.New("bad time, expected YYYY-MM-DD or RFC3339: " + s)
+	}
+	return t, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logging.Error("error encoding response", "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
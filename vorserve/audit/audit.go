@@ -0,0 +1,305 @@
+// Package audit implements a tamper-evident, append-only log of what was
+// done to the stored recordings. Every entry is a separate object holding
+// the SHA-256 hash of the previous entry, so a changed or removed entry
+// breaks the chain, which Verify detects.
+//
+// Entries are stored as <prefix><seq>.json, seq being 12 digits from 1.
+// Before appending, a Log reads the entries other processes appended after
+// its head, so the server and the commands can share a log. Entries are
+// created only if there is none with the sequence number, atomically where
+// the storage supports it (see data.Create), so concurrent writers do not
+// overwrite each other's entries.
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/data"
+)
+
+// the operations logged
+const (
+	OpStore     = "store"
+	OpDelete    = "delete"
+	OpExport    = "export"
+	OpDecrypt   = "decrypt"
+	OpRetention = "retention"
+	OpErasure   = "erasure"
+)
+
+// An Entry is a single operation in the log.
+type Entry struct {
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	// Name of the object the operation concerns, if any
+	Name string `json:"name,omitempty"`
+	// Size and SHA256 of the data stored
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Detail describes the operation, e.g. why an object was deleted
+	Detail map[string]string `json:"detail,omitempty"`
+	// Prev is the hash of the previous entry, empty for the first
+	Prev string `json:"prev"`
+	// Hash is the SHA-256 of the JSON of the entry without the hash
+	Hash string `json:"hash"`
+}
+
+func (e Entry) hash() string {
+	e.Hash = ""
+	buf, _ := json.Marshal(e)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// A Log appends entries to a storage, it is safe for concurrent use.
+type Log struct {
+	storage data.Storage
+	prefix  string
+
+	// OnAppend, if set, is called with every entry appended, e.g. to keep
+	// the head outside the storage
+	OnAppend func(Entry)
+
+	mu   sync.Mutex
+	head Entry
+}
+
+// Open continues the log under prefix in s.
+func Open(s data.Storage, prefix string) (*Log, error) {
+	l := &Log{storage: s, prefix: prefix}
+	objs, err := s.List(prefix)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "error listing audit log")
+	}
+	last := ""
+	for _, o := range objs {
+		if _, ok := parseName(prefix, o.Name); ok && o.Name > last {
+			last = o.Name
+		}
+	}
+	if last == "" {
+		return l, nil
+	}
+	if l.head, err = read(s, last); err != nil {
+		return nil, errgo.NoteMask(err, "error reading last audit entry")
+	}
+	if l.head.hash() != l.head.Hash {
+		return nil, errgo.New("last audit entry " + last + " has been modified, run vorserve audit verify")
+	}
+	return l, nil
+}
+
+// follow the entries appended by others after the head
+func (l *Log) catchUp() error {
+	for {
+		e, err := read(l.storage, entryName(l.prefix, l.head.Seq+1))
+		if data.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return errgo.NoteMask(err, "error reading audit log")
+		}
+		if e.hash() != e.Hash || e.Prev != l.head.Hash {
+			return errgo.Newf("audit entry %v has been modified, run vorserve audit verify", e.Seq)
+		}
+		l.head = e
+	}
+}
+
+// Head returns the last entry appended, with Seq 0 if there is none.
+func (l *Log) Head() Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.head
+}
+
+// how many times Append tries the next entry when others append at the
+// same time
+const maxAppendTries = 10
+
+// Append completes e with its place in the chain and stores it.
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.catchUp(); err != nil {
+		return e, errgo.Mask(err)
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	for tries := 0; ; tries++ {
+		e.Seq = l.head.Seq + 1
+		e.Prev = l.head.Hash
+		e.Hash = e.hash()
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return e, errgo.Mask(err)
+		}
+		err = data.Create(l.storage, entryName(l.prefix, e.Seq), bytes.NewReader(buf), nil)
+		if err == nil {
+			break
+		}
+		if errgo.Cause(err) != data.ErrExists || tries >= maxAppendTries {
+			return e, errgo.NoteMask(err, "error storing audit entry")
+		}
+		// another process appended this entry, follow it and try the next
+		if err := l.catchUp(); err != nil {
+			return e, errgo.Mask(err)
+		}
+	}
+	l.head = e
+	if l.OnAppend != nil {
+		l.OnAppend(e)
+	}
+	return e, nil
+}
+
+func entryName(prefix string, seq int64) string {
+	return fmt.Sprintf("%v%012d.json", prefix, seq)
+}
+
+// the sequence number of an entry object
+func parseName(prefix, name string) (int64, bool) {
+	s := strings.TrimPrefix(name, prefix)
+	if len(s) != 12+len(".json") || !strings.HasSuffix(s, ".json") {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(s[:12], 10, 64)
+	return seq, err == nil && seq > 0
+}
+
+func read(s data.Storage, name string) (Entry, error) {
+	e := Entry{}
+	rc, err := s.Open(name)
+	if err != nil {
+		return e, errgo.Mask(err, data.IsNotExist)
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return e, errgo.Mask(err)
+	}
+	return e, errgo.Mask(json.Unmarshal(buf, &e))
+}
+
+// A Report is the result of verifying a log.
+type Report struct {
+	// Entries is the number of entries read
+	Entries int
+	// Head is the last entry of the chain
+	Head Entry
+	// Problems are the gaps and modified entries found
+	Problems []string
+}
+
+// Verify reads the whole log and checks that it forms a single unbroken
+// chain. Removing the newest entries can not be detected from the log
+// alone, compare the head with one kept elsewhere.
+func Verify(s data.Storage, prefix string) (Report, error) {
+	report := Report{}
+	objs, err := s.List(prefix)
+	if err != nil {
+		return report, errgo.NoteMask(err, "error listing audit log")
+	}
+	seqs := []int64{}
+	for _, o := range objs {
+		seq, ok := parseName(prefix, o.Name)
+		if !ok {
+			report.Problems = append(report.Problems, "unexpected object "+o.Name)
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	prev := Entry{}
+	for _, seq := range seqs {
+		name := entryName(prefix, seq)
+		if seq != prev.Seq+1 {
+			report.Problems = append(report.Problems, fmt.Sprintf("entries %v to %v are missing", prev.Seq+1, seq-1))
+		}
+		e, err := read(s, name)
+		if err != nil {
+			report.Problems = append(report.Problems, name+": "+err.Error())
+			prev = Entry{Seq: seq}
+			continue
+		}
+		report.Entries++
+		switch {
+		case e.Seq != seq || e.hash() != e.Hash:
+			report.Problems = append(report.Problems, name+" has been modified")
+		case seq == 1 && e.Prev != "":
+			report.Problems = append(report.Problems, "the first entry has a previous entry")
+		case seq == prev.Seq+1 && prev.Hash != "" && e.Prev != prev.Hash:
+			report.Problems = append(report.Problems, fmt.Sprintf("entry %v does not follow entry %v, it was modified or overwritten", seq, prev.Seq))
+		}
+		prev = e
+	}
+	report.Head = prev
+	return report, nil
+}
+
+// Storage returns a storage logging every Store and Delete to l, except of
+// the objects of the log itself.
+func Storage(s data.Storage, l *Log) data.Storage {
+	return audited{s, l}
+}
+
+type audited struct {
+	data.Storage
+	log *Log
+}
+
+func (s audited) Store(name string, r io.Reader, meta data.Metadata) error {
+	if strings.HasPrefix(name, s.log.prefix) {
+		return errgo.Mask(s.Storage.Store(name, r, meta), errgo.Any)
+	}
+	h := sha256.New()
+	c := &counter{Reader: io.TeeReader(r, h)}
+	if err := s.Storage.Store(name, c, meta); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	e := Entry{Op: OpStore, Name: name, Size: c.n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	if _, err := s.log.Append(e); err != nil {
+		return errgo.NoteMask(err, name+" was stored but not audited")
+	}
+	return nil
+}
+
+func (s audited) Delete(name string) error {
+	if err := s.Storage.Delete(name); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if strings.HasPrefix(name, s.log.prefix) {
+		return nil
+	}
+	if _, err := s.log.Append(Entry{Op: OpDelete, Name: name}); err != nil {
+		return errgo.NoteMask(err, name+" was deleted but not audited")
+	}
+	return nil
+}
+
+type counter struct {
+	io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/newtechlab/vor/vorserve/data"
+)
+
+const prefix = "audit/log/"
+
+// a folder storage in a temporary directory, removed by the returned func
+func testStorage(t *testing.T) (data.Storage, string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := data.NewStorage("file:" + dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir, func() { os.RemoveAll(dir) }
+}
+
+func appendN(t *testing.T, l *Log, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(Entry{Op: OpStore, Name: "recording.wav"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verify(t *testing.T, s data.Storage) Report {
+	report, err := Verify(s, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func expectProblem(t *testing.T, report Report, want string) {
+	for _, p := range report.Problems {
+		if strings.Contains(p, want) {
+			return
+		}
+	}
+	t.Errorf("expected a problem with %q, got %q", want, report.Problems)
+}
+
+func TestAppendVerify(t *testing.T) {
+	s, _, cleanup := testStorage(t)
+	defer cleanup()
+	l, err := Open(s, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 5)
+	report := verify(t, s)
+	if report.Entries != 5 || len(report.Problems) != 0 || report.Head.Hash != l.Head().Hash {
+		t.Fatalf("expected 5 entries and no problems, got %+v", report)
+	}
+
+	// a log opened later continues the chain
+	l, err = Open(s, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Head().Seq != 5 {
+		t.Fatalf("expected head 5, got %v", l.Head().Seq)
+	}
+	appendN(t, l, 1)
+	if report := verify(t, s); report.Entries != 6 || len(report.Problems) != 0 {
+		t.Fatalf("expected 6 entries and no problems, got %+v", report)
+	}
+}
+
+func TestModifiedEntry(t *testing.T) {
+	s, _, cleanup := testStorage(t)
+	defer cleanup()
+	l, err := Open(s, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 3)
+
+	e, err := read(s, entryName(prefix, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Name = "other.wav"
+	buf, _ := json.Marshal(e)
+	if err := s.Store(entryName(prefix, 2), bytes.NewReader(buf), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectProblem(t, verify(t, s), entryName(prefix, 2)+" has been modified")
+
+	// rehashing the entry breaks the link from the next
+	e.Hash = e.hash()
+	buf, _ = json.Marshal(e)
+	if err := s.Store(entryName(prefix, 2), bytes.NewReader(buf), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectProblem(t, verify(t, s), "entry 3 does not follow entry 2")
+
+	// nor can the head be modified
+	e, err = read(s, entryName(prefix, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Op = OpDelete
+	buf, _ = json.Marshal(e)
+	if err := s.Store(entryName(prefix, 3), bytes.NewReader(buf), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(s, prefix); err == nil {
+		t.Errorf("opened a log with a modified head")
+	}
+}
+
+func TestGap(t *testing.T) {
+	s, _, cleanup := testStorage(t)
+	defer cleanup()
+	l, err := Open(s, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 5)
+	for _, seq := range []int64{2, 3} {
+		if err := s.Delete(entryName(prefix, seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := verify(t, s)
+	if report.Entries != 3 {
+		t.Errorf("expected 3 entries, got %v", report.Entries)
+	}
+	expectProblem(t, report, "entries 2 to 3 are missing")
+}
+
+func TestConcurrentLogs(t *testing.T) {
+	s, _, cleanup := testStorage(t)
+	defer cleanup()
+	const logs, appends = 2, 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < logs; i++ {
+		l, err := Open(s, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < appends; j++ {
+				if _, err := l.Append(Entry{Op: OpStore, Name: "recording.wav"}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	report := verify(t, s)
+	if report.Entries != logs*appends || len(report.Problems) != 0 {
+		t.Errorf("expected %v entries and no problems, got %v entries and %q", logs*appends, report.Entries, report.Problems)
+	}
+}
+
+// an entry that can not be read is an error, not the end of the log
+func TestUnreadableEntry(t *testing.T) {
+	s, dir, cleanup := testStorage(t)
+	defer cleanup()
+	l, err := Open(s, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, l, 2)
+	if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(entryName(prefix, 3))), 0700); err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Append(Entry{Op: OpStore, Name: "recording.wav"})
+	if err == nil || !strings.Contains(err.Error(), "error reading audit log") {
+		t.Errorf("expected an error reading entry 3, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// the audit log is kept under this prefix of the -audit-log storage, or of
+// the -data storage if it is not given
+const auditLogPrefix = auditPrefix + "log/"
+
+var globalAudit *audit.Log
+
+func auditStorage() data.Storage {
+	if fAuditLog == "" {
+		return globalStorage
+	}
+	s, err := data.NewStorage(fAuditLog)
+	if err != nil {
+		logging.Fatal("error creating audit log storage", "error", err)
+	}
+	return s
+}
+
+// open the audit log and log every Store and Delete of globalStorage to
+// it. If the index is open it keeps the head of the log, and the log must
+// not be behind it.
+func setupAudit() {
+	l, err := audit.Open(auditStorage(), auditLogPrefix)
+	if err != nil {
+		logging.Fatal("error opening audit log", "error", err)
+	}
+	if globalIndex != nil {
+		seq, hash, err := globalIndex.AuditHead()
+		if err != nil {
+			logging.Fatal("error reading audit head", "error", err)
+		}
+		head := l.Head()
+		if seq > head.Seq || (seq == head.Seq && hash != head.Hash) {
+			logging.Fatal("the audit log does not contain the last entry written, run vorserve audit verify",
+				"entry", seq, "log_entries", head.Seq)
+		}
+		l.OnAppend = func(e audit.Entry) {
+			if err := globalIndex.SetAuditHead(e.Seq, e.Hash); err != nil {
+				logging.Error("error saving audit head", "error", err)
+			}
+		}
+	}
+	globalAudit = l
+	globalStorage = audit.Storage(globalStorage, l)
+}
+
+// check that the audit log is a single unbroken chain, and, if the index
+// exists, that it ends with the last entry the index knows of.
+func runAuditVerify() {
+	setupStorage()
+	report, err := audit.Verify(auditStorage(), auditLogPrefix)
+	if err != nil {
+		logging.Fatal("error verifying audit log", "error", err)
+	}
+	if _, err := os.Stat(fDB); err == nil {
+		setupIndex()
+		seq, hash, err := globalIndex.AuditHead()
+		globalIndex.Close()
+		switch {
+		case err != nil:
+			logging.Fatal("error reading audit head", "error", err)
+		case seq > report.Head.Seq:
+			report.Problems = append(report.Problems, fmt.Sprintf("entries %v to %v, the last ones written, are missing", report.Head.Seq+1, seq))
+		case seq > 0 && seq == report.Head.Seq && hash != report.Head.Hash:
+			report.Problems = append(report.Problems, fmt.Sprintf("entry %v is not the last one written", seq))
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		fmt.Printf("problems (%v):\n", len(report.Problems))
+		for _, p := range report.Problems {
+			fmt.Println("  " + p)
+		}
+	}
+	fmt.Printf("%v entries, %v problems\n", report.Entries, len(report.Problems))
+	if report.Head.Seq > 0 {
+		fmt.Printf("last entry %v at %v, hash %v\n", report.Head.Seq, report.Head.Time.Format("2006-01-02 15:04:05"), report.Head.Hash)
+	}
+	if len(report.Problems) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// number of digits of a reference code
+const codeDigits = 10
+
+// referenceCode derives the code a caller is given for a recording from its
+// name. Codes are digits only, so they can be read out and keyed in on a
+// phone, and long enough that recordings rarely share one.
+func referenceCode(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return fmt.Sprintf("%010d", binary.BigEndian.Uint64(sum[:8])%10000000000)
+}
+
+// the code as given by a caller or researcher, ignoring spaces and dashes
+func normalizeCode(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// the code with spaces between the digits, so that it is read digit by
+// digit by text to speech
+func spokenCode(code string) string {
+	return strings.Join(strings.Split(code, ""), " ")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+	"gopkg.in/yaml.v2"
+)
+
+// flags that only make sense on the command line
+var notConfigurable = map[string]bool{"h": true, "config": true, "dump-config": true}
+
+// loadConfig sets the flags not given on the command line from the config
+// file and environment, in order of precedence: command line, environment,
+// config file and the defaults. Values are parsed and checked by the flags.
+func loadConfig() error {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	path := fConfig
+	if !given["config"] {
+		if env, ok := os.LookupEnv(envName("config")); ok {
+			path = env
+		}
+	}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return errgo.NoteMask(err, "error reading config "+path)
+		}
+		for name, v := range values {
+			if given[name] {
+				continue
+			}
+			if err := flag.Set(name, v); err != nil {
+				return errgo.Newf("bad value %q for %v in %v: %v", v, name, path, err)
+			}
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || notConfigurable[f.Name] {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if e := flag.Set(f.Name, v); e != nil {
+				err = errgo.Newf("bad value %q for %v: %v", v, envName(f.Name), e)
+			}
+		}
+	})
+	return err
+}
+
+// the environment variable overriding a flag, e.g. VORSERVE_MIN_FREE
+func envName(flagName string) string {
+	return "VORSERVE_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// read a YAML file of flag names and values, lists are joined by commas
+func readConfigFile(path string) (map[string]string, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	raw := map[string]configValue{}
+	if err := yaml.UnmarshalStrict(buf, &raw); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	values := map[string]string{}
+	for name, v := range raw {
+		if flag.Lookup(name) == nil || notConfigurable[name] {
+			return nil, errgo.New("unknown setting " + name)
+		}
+		values[name] = string(v)
+	}
+	return values, nil
+}
+
+// a value as written in the file, so that it is parsed by the flag
+type configValue string
+
+func (v *configValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*v = configValue(s)
+		return nil
+	}
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return errgo.New("settings must be a value or a list of values")
+	}
+	*v = configValue(strings.Join(l, ","))
+	return nil
+}
+
+// print an annotated config file with the default values
+func showConfig() {
+	fmt.Println("# vorserve configuration, pass with -config or VORSERVE_CONFIG.")
+	fmt.Println("# Each setting can be overridden by the environment variable")
+	fmt.Println("# VORSERVE_<NAME>, e.g. VORSERVE_MIN_FREE, and by the flag -<name>.")
+	flag.VisitAll(func(f *flag.Flag) {
+		if notConfigurable[f.Name] {
+			return
+		}
+		v := f.Value.(flag.Getter).Get()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		buf, err := yaml.Marshal(map[string]interface{}{f.Name: v})
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("")
+		fmt.Println("# " + f.Usage)
+		fmt.Print(string(buf))
+	})
+	os.Exit(0)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/envelope"
+	"github.com/newtechlab/vor/vorserve/index"
+)
+
+// the recorded consent is stored next to the recording as <name>.consent.wav
+const consentSuffix = ".consent.wav"
+
+// the consent evidence sent by vorgen, nil if the flow does not send it
+func parseConsent(r *http.Request) *index.Consent {
+	hash, version := r.FormValue("consent_text_hash"), r.FormValue("consent_version")
+	if hash == "" && version == "" {
+		return nil
+	}
+	c := &index.Consent{
+		Version:  version,
+		Speech:   r.FormValue("consent_speech"),
+		TextHash: hash,
+		Lang:     r.FormValue("consent_lang"),
+	}
+	c.Confidence, _ = strconv.ParseFloat(r.FormValue("consent_confidence"), 64)
+	// unix seconds from liquid, or RFC3339
+	t := r.FormValue("consent_time")
+	if s, err := strconv.ParseInt(t, 10, 64); err == nil {
+		c.Time = time.Unix(s, 0).UTC()
+	} else if ts, err := time.Parse(time.RFC3339, t); err == nil {
+		c.Time = ts.UTC()
+	}
+	return c
+}
+
+func consentName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + consentSuffix
+}
+
+// the recording the recorded consent belongs to
+func consentOf(name string) string {
+	return strings.TrimSuffix(name, consentSuffix) + ".wav"
+}
+
+// download the recorded consent and encode it like the recording, it is
+// stored when the name of the recording is known
+func fetchConsent(url string) ([]byte, error) {
+	buf, err := getWaveBuffer(url)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	r, err := writeWaveFile(buf)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if globalEncryptionKey != nil {
+		if r, err = envelope.Encrypt(r, globalEncryptionKey); err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	return b, errgo.Mask(err)
+}
+
+// store the recorded consent of rec, before the recording itself so that
+// a stored recording always has its evidence
+func storeConsent(rec *index.Recording, buf []byte) error {
+	if buf == nil {
+		return nil
+	}
+	sum := sha256.Sum256(buf)
+	rec.Consent.Recording = consentName(rec.Name)
+	rec.Consent.RecordingSHA256 = hex.EncodeToString(sum[:])
+	meta := consentMetadata(rec)
+	meta["sha256"] = rec.Consent.RecordingSHA256
+	return errgo.Mask(globalStorage.Store(rec.Consent.Recording, bytes.NewReader(buf), meta))
+}
+
+// the metadata of the recorded consent, without its hash
+func consentMetadata(rec *index.Recording) data.Metadata {
+	meta := data.Metadata{"speaker-id": rec.Speaker}
+	if rec.Encryption != "" {
+		meta["encryption"] = rec.Encryption
+	}
+	return meta
+}
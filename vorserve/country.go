@@ -0,0 +1,41 @@
+package main
+
+import "strings"
+
+// two digit country calling codes, all codes starting with 1 or 7 have a
+// single digit and the rest have three. Since calling codes are prefix free
+// this is enough to find the code of any E.164 number.
+var callingCodes2 = map[string]bool{
+	"20": true, "27": true, "30": true, "31": true, "32": true, "33": true,
+	"34": true, "36": true, "39": true, "40": true, "41": true, "43": true,
+	"44": true, "45": true, "46": true, "47": true, "48": true, "49": true,
+	"51": true, "52": true, "53": true, "54": true, "55": true, "56": true,
+	"57": true, "58": true, "60": true, "61": true, "62": true, "63": true,
+	"64": true, "65": true, "66": true, "81": true, "82": true, "84": true,
+	"86": true, "90": true, "91": true, "92": true, "93": true, "94": true,
+	"95": true, "98": true,
+}
+
+// countryCode returns the calling code of a phone number in E.164 format,
+// e.g. 47 for +4712345678, or an empty string if it is not such a number.
+// Coarse enough to be kept alongside the pseudonymous id.
+func countryCode(phone string) string {
+	if !strings.HasPrefix(phone, "+") {
+		return ""
+	}
+	digits := phone[1:]
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return ""
+		}
+	}
+	switch {
+	case len(digits) < 4:
+		return ""
+	case digits[0] == '1' || digits[0] == '7':
+		return digits[:1]
+	case callingCodes2[digits[:2]]:
+		return digits[:2]
+	}
+	return digits[:3]
+}
@@ -0,0 +1,12 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package data
+
+import "syscall"
+
+// canWrite checks that we may create files in the folder dir.
+func canWrite(dir string) error {
+	const wOK, xOK = 0x2, 0x1
+	return syscall.Access(dir, wOK|xOK)
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package data
+
+import (
+	"os"
+
+	"github.com/juju/errgo"
+)
+
+// canWrite checks the permission bits of dir, as access(2) is not
+// available on this platform.
+func canWrite(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0200 == 0 {
+		return errgo.New("folder is not writable")
+	}
+	return nil
+}
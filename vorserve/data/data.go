@@ -2,30 +2,176 @@ package data
 
 import (
 	"io"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/metrics"
 )
 
+var storageErrors = metrics.NewCounter("vorserve_storage_errors_total",
+	"Failed storage operations by backend and operation.", "backend", "op")
+
 type Storage interface {
-	Store(path string, data io.Reader) error
+	// Store writes data to path, with metadata where the backend supports it
+	Store(path string, data io.Reader, meta Metadata) error
+	// Open returns the content of a stored object, it must be closed. If
+	// there is no object IsNotExist is true for the error.
+	Open(path string) (io.ReadCloser, error)
+	// List returns all objects with names starting with prefix
+	List(prefix string) ([]Object, error)
+	// Delete removes an object, deleting a missing object is not an error
+	Delete(path string) error
+	// Check verifies that the storage is reachable and writable without
+	// touching any stored data
+	Check() error
+}
+
+// ErrExists is returned by Create when there already is an object with the
+// name.
+var ErrExists = errgo.New("object already exists")
+
+// A Creator is a Storage that can store an object only if there is none
+// with the name, atomically, so concurrent writers do not overwrite each
+// other.
+type Creator interface {
+	Create(path string, data io.Reader, meta Metadata) error
+}
+
+// Create stores data to path unless there already is an object, failing
+// with ErrExists if so. Storages that are not Creators are checked first,
+// which does not protect against concurrent writers.
+func Create(s Storage, path string, data io.Reader, meta Metadata) error {
+	if c, ok := s.(Creator); ok {
+		return errgo.Mask(c.Create(path, data, meta), errgo.Is(ErrExists))
+	}
+	rc, err := s.Open(path)
+	if err == nil {
+		rc.Close()
+		return errgo.WithCausef(nil, ErrExists, "%v", path)
+	}
+	if !IsNotExist(err) {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(s.Store(path, data, meta))
+}
+
+// IsNotExist tells if Open failed because there is no object, rather than
+// e.g. because the storage could not be reached.
+func IsNotExist(err error) bool {
+	cause := errgo.Cause(err)
+	return os.IsNotExist(cause) || isNotFound(cause)
+}
+
+// A MetadataReader is a Storage that keeps the metadata of objects.
+type MetadataReader interface {
+	Metadata(path string) (Metadata, error)
+}
+
+// ReadMetadata returns the metadata of an object, nil if the storage does
+// not keep metadata.
+func ReadMetadata(s Storage, path string) (Metadata, error) {
+	if mr, ok := s.(MetadataReader); ok {
+		meta, err := mr.Metadata(path)
+		return meta, errgo.Mask(err, errgo.Any)
+	}
+	return nil, nil
+}
+
+// Metadata is stored alongside an object, keys are lower case words
+// separated by dashes.
+type Metadata map[string]string
+
+// An Object describes an object held by a Storage.
+type Object struct {
+	Name     string
+	Size     int64
+	Modified time.Time
 }
 
 func NewStorage(path string) (Storage, error) {
 	parts := strings.SplitN(path, ":", 2)
 	if len(parts) != 2 {
-		return nil, errgo.New("unrecognized data specifier, should start with s3: or file:")
+		return nil, errgo.New("unrecognized data specifier, should start with s3:, file: or replicate:")
 	}
 	typ, arg := parts[0], parts[1]
 	if arg == "" {
 		return nil, errgo.New("bad data specifier")
 	}
 
+	var s Storage
+	var err error
 	switch typ {
 	case "s3":
-		return newS3Storage(arg)
+		s, err = newS3Storage(arg)
 	case "file":
-		return newFolderStorage(arg)
+		s, err = newFolderStorage(arg)
+	case "replicate":
+		s, err = newReplicated(arg)
+	default:
+		return nil, errgo.New("unknown data type specifier")
+	}
+	if err != nil {
+		storageErrors.Inc(typ, "setup")
+		return nil, errgo.Mask(err)
 	}
-	return nil, errgo.New("unknown data type specifier")
+	return instrumented{s, typ}, nil
+}
+
+// instrumented counts the errors of a storage backend
+type instrumented struct {
+	Storage
+	backend string
+}
+
+func (s instrumented) count(op string, err error) {
+	if err != nil {
+		storageErrors.Inc(s.backend, op)
+	}
+}
+
+func (s instrumented) Store(path string, data io.Reader, meta Metadata) error {
+	err := s.Storage.Store(path, data, meta)
+	s.count("store", err)
+	return err
+}
+
+func (s instrumented) Create(path string, data io.Reader, meta Metadata) error {
+	err := Create(s.Storage, path, data, meta)
+	if errgo.Cause(err) != ErrExists {
+		s.count("create", err)
+	}
+	return errgo.Mask(err, errgo.Is(ErrExists))
+}
+
+func (s instrumented) Metadata(path string) (Metadata, error) {
+	meta, err := ReadMetadata(s.Storage, path)
+	s.count("metadata", err)
+	return meta, errgo.Mask(err, errgo.Any)
+}
+
+func (s instrumented) Open(path string) (io.ReadCloser, error) {
+	r, err := s.Storage.Open(path)
+	s.count("open", err)
+	return r, err
+}
+
+func (s instrumented) List(prefix string) ([]Object, error) {
+	objs, err := s.Storage.List(prefix)
+	s.count("list", err)
+	return objs, err
+}
+
+func (s instrumented) Delete(path string) error {
+	err := s.Storage.Delete(path)
+	s.count("delete", err)
+	return err
+}
+
+func (s instrumented) Check() error {
+	err := s.Storage.Check()
+	s.count("check", err)
+	return err
 }
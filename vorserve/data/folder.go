@@ -3,8 +3,13 @@ package data
 import (
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/juju/errgo"
 )
@@ -13,7 +18,26 @@ func maybeCreate(path string) {
 	os.MkdirAll(path, 0700)
 }
 
-func newFolderStorage(path string) (Storage, error) {
+// newFolderStorage stores objects in the folder given as path, optionally
+// followed by ?shard=id or ?shard=date to spread them over subfolders.
+func newFolderStorage(arg string) (Storage, error) {
+	path, shard := arg, ""
+	if i := strings.LastIndex(arg, "?"); i >= 0 {
+		q, err := url.ParseQuery(arg[i+1:])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		path, shard = arg[:i], q.Get("shard")
+		for k := range q {
+			if k != "shard" {
+				return nil, errgo.New("unknown file option: " + k)
+			}
+		}
+		if shard != "id" && shard != "date" {
+			return nil, errgo.New("shard must be id or date, not: " + shard)
+		}
+	}
+
 	// create the folder if needed, make sure we have permissions
 	// to write to it
 	maybeCreate(path)
@@ -24,41 +48,210 @@ func newFolderStorage(path string) (Storage, error) {
 	if !fi.IsDir() {
 		return nil, errgo.New("not a folder: " + path)
 	}
-	f, err := ioutil.TempFile(path, "")
-	fileName := f.Name()
-	defer f.Close()
-	if err != nil {
-		return nil, errgo.NoteMask(err, "could not create file in datadir")
-	}
-	n, err := f.Write([]byte{1, 2, 3, 4})
-	if err != nil {
-		return nil, errgo.NoteMask(err, "could not write to file in datadir")
+	fs := folderStorage{root: path, shard: shard}
+	if err := fs.Check(); err != nil {
+		return nil, errgo.Mask(err)
 	}
-	if n != 4 {
-		return nil, errgo.New("not all content written to file")
+	return fs, nil
+}
+
+// folderStorage keeps each object in a file named as the object. With
+// sharding the file is put in a subfolder named by the first two characters
+// of the name (id), or the date of the timestamp in the name (date), e.g.
+// ab/abc_1574082000000000000.wav or 2019/11/18/abc_1574082000000000000.wav.
+// Names are the same with and without sharding, and files stored before
+// sharding was enabled are still found.
+type folderStorage struct {
+	root  string
+	shard string
+}
+
+// files being written, they are skipped when listing
+const tempPrefix = ".tmp-"
+
+// the subfolder of the shard of a file, empty if not sharded
+func (f folderStorage) shardDir(base string) string {
+	switch f.shard {
+	case "id":
+		if len(base) > 2 {
+			return base[:2]
+		}
+	case "date":
+		ext := filepath.Ext(base)
+		i := strings.LastIndex(base, "_")
+		if i < 0 || i >= len(base)-len(ext) {
+			break
+		}
+		nanos, err := strconv.ParseInt(base[i+1:len(base)-len(ext)], 10, 64)
+		if err != nil {
+			break
+		}
+		return time.Unix(0, nanos).UTC().Format("2006/01/02")
 	}
-	err = f.Close()
+	return ""
+}
+
+// the path of the file holding the object name
+func (f folderStorage) path(name string) string {
+	dir, base := path.Split(name)
+	return filepath.Join(f.root, filepath.FromSlash(dir), filepath.FromSlash(f.shardDir(base)), base)
+}
+
+// Check makes sure the folder exists and we have permissions to write to
+// it, without creating anything in it.
+func (f folderStorage) Check() error {
+	fi, err := os.Stat(f.root)
 	if err != nil {
-		return nil, errgo.NoteMask(err, "error flushing/closing file in datadir")
+		return errgo.NoteMask(err, "could not stat datadir")
+	}
+	if !fi.IsDir() {
+		return errgo.New("not a folder: " + f.root)
 	}
-	if err := os.Remove(fileName); err != nil {
-		return nil, errgo.NoteMask(err, "could not delete file in datadir")
+	if err := canWrite(f.root); err != nil {
+		return errgo.NoteMask(err, "no write access to datadir")
 	}
+	return nil
+}
 
-	return folderStorage(path), nil
+// Store writes data to a temporary file next to the final one, which is
+// synced and renamed into place, so that a crash never leaves a partly
+// written file under the name of the object. Metadata is not kept.
+func (f folderStorage) Store(name string, data io.Reader, meta Metadata) error {
+	return errgo.Mask(f.write(name, data, os.Rename))
 }
 
-type folderStorage string
+// Create is like Store, but links the temporary file into place, which
+// fails if the file exists.
+func (f folderStorage) Create(name string, data io.Reader, meta Metadata) error {
+	err := f.write(name, data, os.Link)
+	if le, ok := err.(*os.LinkError); ok && os.IsExist(le.Err) {
+		return errgo.WithCausef(nil, ErrExists, "%v", name)
+	}
+	return errgo.Mask(err)
+}
 
-func (f folderStorage) Store(name string, data io.Reader) error {
-	fi, err := os.Create(filepath.Join(string(f), name))
-	defer fi.Close()
+// write data to a temporary file and move it into place with put
+func (f folderStorage) write(name string, data io.Reader, put func(from, to string) error) error {
+	dst := f.path(name)
+	dir := filepath.Dir(dst)
+	if err := mkdirSync(dir); err != nil {
+		return errgo.Mask(err)
+	}
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	_, err = io.Copy(fi, data)
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return errgo.Mask(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errgo.Mask(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := put(tmp.Name(), dst); err != nil {
+		// not masked, Create looks at the cause
+		return err
+	}
+	return errgo.Mask(syncDir(dir))
+}
+
+// create dir and the missing folders above it, syncing the parent of each
+// folder created so that they are all durable, as sharding can create
+// several levels at once
+func mkdirSync(dir string) error {
+	missing := []string{}
+	for d := dir; ; d = filepath.Dir(d) {
+		_, err := os.Stat(d)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return errgo.Mask(err)
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	for _, d := range missing {
+		if err := syncDir(filepath.Dir(d)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// sync a directory, making renames and new files in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	return errgo.Mask(fi.Close())
+	defer d.Close()
+	return errgo.Mask(d.Sync())
+}
+
+func (f folderStorage) Open(name string) (io.ReadCloser, error) {
+	fi, err := os.Open(f.path(name))
+	if os.IsNotExist(err) && f.shard != "" {
+		// stored before sharding was enabled
+		fi, err = os.Open(filepath.Join(f.root, filepath.FromSlash(name)))
+	}
+	return fi, errgo.Mask(err, os.IsNotExist)
+}
+
+func (f folderStorage) Delete(name string) error {
+	for _, p := range []string{f.path(name), filepath.Join(f.root, filepath.FromSlash(name))} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+func (f folderStorage) List(prefix string) ([]Object, error) {
+	objs := []Object{}
+	err := filepath.Walk(f.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(f.root, path)
+		if err != nil {
+			return err
+		}
+		name := f.name(filepath.ToSlash(rel))
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, Object{
+				Name:     name,
+				Size:     fi.Size(),
+				Modified: fi.ModTime(),
+			})
+		}
+		return nil
+	})
+	return objs, errgo.Mask(err)
+}
+
+// the name of the object in the file rel, the inverse of path
+func (f folderStorage) name(rel string) string {
+	dir, base := path.Split(rel)
+	shard := f.shardDir(base)
+	if shard != "" && (dir == shard+"/" || strings.HasSuffix(dir, "/"+shard+"/")) {
+		return dir[:len(dir)-len(shard)-1] + base
+	}
+	return rel
 }
@@ -0,0 +1,391 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// the replication policies, when a write to the replicas succeeds
+const (
+	// every backend must succeed
+	policyAll = "all"
+	// a majority of the backends must succeed
+	policyQuorum = "quorum"
+	// the first backend must succeed, the others are written in the background
+	policyPrimary = "primary"
+)
+
+// replicated writes every object to several backends. It is specified as
+// replicate:<policy>;<data specifier>;<data specifier>..., the first backend
+// is the primary, which is read from first.
+type replicated struct {
+	policy   string
+	names    []string
+	backends []Storage
+}
+
+func newReplicated(arg string) (Storage, error) {
+	parts := strings.Split(arg, ";")
+	policy, specs := parts[0], parts[1:]
+	switch policy {
+	case policyAll, policyQuorum, policyPrimary:
+	default:
+		return nil, errgo.New("replication policy must be all, quorum or primary, not: " + policy)
+	}
+	if len(specs) < 2 {
+		return nil, errgo.New("replication needs at least two data specifiers separated by ;")
+	}
+	r := &replicated{policy: policy}
+	for _, spec := range specs {
+		if strings.HasPrefix(spec, "replicate:") {
+			return nil, errgo.New("replicated storages can not be nested")
+		}
+		s, err := NewStorage(spec)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "error creating "+spec)
+		}
+		r.names = append(r.names, strings.SplitN(spec, "?", 2)[0])
+		r.backends = append(r.backends, s)
+	}
+	return r, nil
+}
+
+// the number of backends that must succeed
+func (r *replicated) needed() int {
+	switch r.policy {
+	case policyQuorum:
+		return len(r.backends)/2 + 1
+	case policyPrimary:
+		return 1
+	}
+	return len(r.backends)
+}
+
+// Store writes the object to the backends as required by the policy, the
+// data is kept in memory while written.
+func (r *replicated) Store(name string, data io.Reader, meta Metadata) error {
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if r.policy == policyPrimary {
+		if err := r.backends[0].Store(name, bytes.NewReader(buf), meta); err != nil {
+			return errgo.Mask(err)
+		}
+		r.storeSecondaries(name, buf, meta)
+		return nil
+	}
+	return errgo.Mask(r.each(func(i int, s Storage) error {
+		return s.Store(name, bytes.NewReader(buf), meta)
+	}))
+}
+
+// Create creates the object on the primary, which decides whether it
+// exists, and then writes it to the others as Store does.
+func (r *replicated) Create(name string, data io.Reader, meta Metadata) error {
+	buf, err := ioutil.ReadAll(data)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := Create(r.backends[0], name, bytes.NewReader(buf), meta); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrExists))
+	}
+	if r.policy == policyPrimary {
+		r.storeSecondaries(name, buf, meta)
+		return nil
+	}
+	return errgo.Mask(r.each(func(i int, s Storage) error {
+		if i == 0 {
+			return nil
+		}
+		return s.Store(name, bytes.NewReader(buf), meta)
+	}))
+}
+
+// the writes to secondaries going on in the background
+var (
+	background        sync.WaitGroup
+	backgroundPending int64
+)
+
+// Wait waits for the writes to secondaries going on in the background, it
+// must be called before exiting, or they are lost until repaired.
+func Wait() {
+	background.Wait()
+}
+
+// Pending returns the number of writes to secondaries not done yet.
+func Pending() int {
+	return int(atomic.LoadInt64(&backgroundPending))
+}
+
+// write to the secondaries in the background
+func (r *replicated) storeSecondaries(name string, buf []byte, meta Metadata) {
+	for i := 1; i < len(r.backends); i++ {
+		background.Add(1)
+		atomic.AddInt64(&backgroundPending, 1)
+		go func(i int) {
+			defer background.Done()
+			defer atomic.AddInt64(&backgroundPending, -1)
+			if err := r.backends[i].Store(name, bytes.NewReader(buf), meta); err != nil {
+				logging.Error("error writing to secondary, run vorserve repair", "backend", r.names[i], "name", name, "error", err)
+			}
+		}(i)
+	}
+}
+
+// Check checks the backends, and fails unless as many as needed are ok
+func (r *replicated) Check() error {
+	if r.policy == policyPrimary {
+		for i := 1; i < len(r.backends); i++ {
+			if err := r.backends[i].Check(); err != nil {
+				logging.Warn("secondary storage check failed", "backend", r.names[i], "error", err)
+			}
+		}
+		return errgo.Mask(r.backends[0].Check())
+	}
+	return errgo.Mask(r.each(func(i int, s Storage) error {
+		return s.Check()
+	}))
+}
+
+// call f for all backends in parallel, failing if fewer than needed succeed
+func (r *replicated) each(f func(i int, s Storage) error) error {
+	errs := make([]error, len(r.backends))
+	wg := sync.WaitGroup{}
+	for i, s := range r.backends {
+		wg.Add(1)
+		go func(i int, s Storage) {
+			defer wg.Done()
+			errs[i] = f(i, s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	msgs := []string{}
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, r.names[i]+": "+err.Error())
+		}
+	}
+	if len(r.backends)-len(msgs) < r.needed() {
+		return errgo.Newf("%v of %v backends failed: %v", len(msgs), len(r.backends), strings.Join(msgs, "; "))
+	}
+	// enough succeeded, the replicas that failed are repaired later
+	for _, msg := range msgs {
+		logging.Error("replica failed, run vorserve repair", "error", msg)
+	}
+	return nil
+}
+
+// Delete deletes the object from all backends, whatever the policy, so
+// that repair does not bring it back.
+func (r *replicated) Delete(name string) error {
+	errs := make([]error, len(r.backends))
+	wg := sync.WaitGroup{}
+	for i, s := range r.backends {
+		wg.Add(1)
+		go func(i int, s Storage) {
+			defer wg.Done()
+			errs[i] = s.Delete(name)
+		}(i, s)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return errgo.NoteMask(err, "error deleting from "+r.names[i])
+		}
+	}
+	return nil
+}
+
+// Open reads from the first backend having the object.
+func (r *replicated) Open(name string) (io.ReadCloser, error) {
+	var err error
+	for _, s := range r.backends {
+		var rc io.ReadCloser
+		if rc, err = s.Open(name); err == nil {
+			return rc, nil
+		}
+	}
+	return nil, errgo.Mask(err, errgo.Any)
+}
+
+// List lists the objects of all backends, an object in several backends is
+// described as by the first.
+func (r *replicated) List(prefix string) ([]Object, error) {
+	seen := map[string]bool{}
+	objs := []Object{}
+	for i, s := range r.backends {
+		bobjs, err := s.List(prefix)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "error listing "+r.names[i])
+		}
+		for _, o := range bobjs {
+			if !seen[o.Name] {
+				seen[o.Name] = true
+				objs = append(objs, o)
+			}
+		}
+	}
+	return objs, nil
+}
+
+// A RepairReport describes the differences between replicas.
+type RepairReport struct {
+	// Copied are the objects copied to backends missing them
+	Copied []string
+	// Conflicts are objects with different sizes or hashes in different
+	// backends, they are not changed
+	Conflicts []string
+	// Failed are the copies that failed
+	Failed []string
+}
+
+// Repair copies objects missing in some of the backends of a replicated
+// storage to them, from the first backend having them. The metadata is
+// copied from that backend if it keeps it, otherwise it is given by meta,
+// which may be nil, and the sha256 of the content is added. Replicas are
+// compared by size, and by the sha256 in their metadata where the
+// backends keep it. With dryRun only the report is made. copied, if not
+// nil, is called after each copy, e.g. to log it, an error is reported as a
+// failure.
+func Repair(s Storage, dryRun bool, meta func(from Storage, name string) Metadata, copied func(name, backend string, size int64, sha256 string) error) (RepairReport, error) {
+	report := RepairReport{}
+	if i, ok := s.(instrumented); ok {
+		s = i.Storage
+	}
+	r, ok := s.(*replicated)
+	if !ok {
+		return report, errgo.New("repair needs a replicate: data specifier")
+	}
+
+	// the size of each object in each backend
+	sizes := map[string][]int64{}
+	for i, b := range r.backends {
+		objs, err := b.List("")
+		if err != nil {
+			return report, errgo.NoteMask(err, "error listing "+r.names[i])
+		}
+		for _, o := range objs {
+			if sizes[o.Name] == nil {
+				sizes[o.Name] = make([]int64, len(r.backends))
+				for j := range sizes[o.Name] {
+					sizes[o.Name][j] = -1
+				}
+			}
+			sizes[o.Name][i] = o.Size
+		}
+	}
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		src, srcHash := -1, ""
+		for i, size := range sizes[name] {
+			if size < 0 {
+				continue
+			}
+			if src < 0 {
+				src = i
+				continue
+			}
+			if size != sizes[name][src] {
+				report.Conflicts = append(report.Conflicts, name+" differs in "+r.names[src]+" and "+r.names[i])
+				continue
+			}
+			if srcHash == "" {
+				srcHash = storedHash(r.backends[src], name)
+			}
+			if h := storedHash(r.backends[i], name); h != "" && srcHash != "" && h != srcHash {
+				report.Conflicts = append(report.Conflicts, name+" has a different sha256 in "+r.names[src]+" and "+r.names[i])
+			}
+		}
+		for i, size := range sizes[name] {
+			if size >= 0 {
+				continue
+			}
+			line := name + " to " + r.names[i]
+			if dryRun {
+				report.Copied = append(report.Copied, line)
+				continue
+			}
+			size, hash, err := copyObject(r.backends[src], r.backends[i], name, meta)
+			if err != nil {
+				report.Failed = append(report.Failed, line+": "+err.Error())
+				continue
+			}
+			if copied != nil {
+				if err := copied(name, r.names[i], size, hash); err != nil {
+					report.Failed = append(report.Failed, line+": copied, but "+err.Error())
+					continue
+				}
+			}
+			report.Copied = append(report.Copied, line)
+		}
+	}
+	return report, nil
+}
+
+// the sha256 in the metadata of an object, empty if not known
+func storedHash(s Storage, name string) string {
+	meta, err := ReadMetadata(s, name)
+	if err != nil {
+		return ""
+	}
+	return meta["sha256"]
+}
+
+// copy an object with its metadata, checking the content against the
+// sha256 of the source if it has one, it returns the size and sha256 of
+// the content copied
+func copyObject(from, to Storage, name string, metaFunc func(Storage, string) Metadata) (int64, string, error) {
+	rc, err := from.Open(name)
+	if err != nil {
+		return 0, "", errgo.Mask(err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return 0, "", errgo.Mask(err)
+	}
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+
+	src, err := ReadMetadata(from, name)
+	if err != nil {
+		return 0, "", errgo.NoteMask(err, "error reading metadata")
+	}
+	if len(src) == 0 && metaFunc != nil {
+		src = metaFunc(from, name)
+	}
+	var meta Metadata
+	if src != nil {
+		meta = Metadata{}
+		for k, v := range src {
+			meta[k] = v
+		}
+		if h, ok := meta["sha256"]; ok && h != hash {
+			return 0, "", errgo.New("the content does not match the sha256 of the source, not copied")
+		}
+		meta["sha256"] = hash
+	}
+	if err := to.Store(name, bytes.NewReader(buf), meta); err != nil {
+		return 0, "", errgo.Mask(err)
+	}
+	return int64(len(buf)), hash, nil
+}
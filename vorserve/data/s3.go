@@ -4,58 +4,271 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/s3manager"
 	"github.com/juju/errgo"
 )
 
-func newS3Storage(bucket string) (Storage, error) {
+// s3Config is parsed from the data specifier, either s3:bucket or
+// s3://bucket/prefix?endpoint=http://localhost:9000&path_style=true&region=eu-north-1
+type s3Config struct {
+	bucket    string
+	prefix    string
+	endpoint  string
+	region    string
+	pathStyle bool
+
+	// upload options
+	sse          string
+	kmsKeyID     string
+	storageClass string
+	tags         url.Values
+}
+
+func parseS3Config(arg string) (s3Config, error) {
+	if !strings.HasPrefix(arg, "//") {
+		return s3Config{bucket: arg}, nil
+	}
+	u, err := url.Parse("s3:" + arg)
+	if err != nil {
+		return s3Config{}, errgo.Mask(err)
+	}
+	c := s3Config{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), tags: url.Values{}}
+	if c.bucket == "" {
+		return c, errgo.New("no bucket given in s3 data specifier")
+	}
+	if c.prefix != "" {
+		c.prefix += "/"
+	}
+	for k, v := range u.Query() {
+		switch k {
+		case "endpoint":
+			c.endpoint = v[0]
+		case "region":
+			c.region = v[0]
+		case "path_style":
+			if c.pathStyle, err = strconv.ParseBool(v[0]); err != nil {
+				return c, errgo.New("bad path_style: " + v[0])
+			}
+		case "sse":
+			c.sse = v[0]
+		case "kms_key_id":
+			c.kmsKeyID = v[0]
+		case "storage_class":
+			c.storageClass = v[0]
+		case "tag":
+			for _, t := range v {
+				kv := strings.SplitN(t, ":", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return c, errgo.New("tags must be given as key:value, not: " + t)
+				}
+				c.tags.Add(kv[0], kv[1])
+			}
+		default:
+			return c, errgo.New("unknown s3 option: " + k)
+		}
+	}
+	switch c.sse {
+	case "", string(s3.ServerSideEncryptionAes256):
+		if c.kmsKeyID != "" {
+			return c, errgo.New("kms_key_id requires sse=aws:kms")
+		}
+	case string(s3.ServerSideEncryptionAwsKms):
+	default:
+		return c, errgo.New("sse must be AES256 or aws:kms, not: " + c.sse)
+	}
+	return c, nil
+}
+
+func newS3Storage(arg string) (Storage, error) {
+	c, err := parseS3Config(arg)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if c.region != "" {
+		cfg.Region = c.region
+	}
+	if c.endpoint != "" {
+		cfg.EndpointResolver = aws.ResolveWithEndpointURL(c.endpoint)
+		if cfg.Region == "" {
+			// most S3 compatible servers ignore the region, but it
+			// must be set to sign requests
+			cfg.Region = "us-east-1"
+		}
+	}
+	svc := s3.New(cfg)
+	svc.ForcePathStyle = c.pathStyle
 	s3s := s3Storage{
-		upl:    s3manager.NewUploader(cfg),
-		bucket: bucket,
+		upl:    s3manager.NewUploaderWithClient(svc),
+		bucket: c.bucket,
+		prefix: c.prefix,
+		config: c,
+	}
+
+	if err := s3s.probe(); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &s3s, nil
+}
+
+type s3Storage struct {
+	upl    *s3manager.Uploader
+	bucket string
+	// prepended to all object names
+	prefix string
+	config s3Config
+}
+
+var contentTypes = map[string]string{
+	".wav":  "audio/wav",
+	".json": "application/json",
+}
+
+// the upload of an object with the configured encryption, storage class
+// and tags. A type tag with the extension of the name is added, so that
+// lifecycle rules can tell recordings and sidecars apart.
+func (s3s *s3Storage) uploadInput(name string, data io.Reader, meta Metadata) *s3manager.UploadInput {
+	ext := path.Ext(name)
+	typ, ok := contentTypes[ext]
+	if !ok {
+		typ = "application/octet-stream"
+	}
+	tags := url.Values{}
+	for k, v := range s3s.config.tags {
+		tags[k] = v
+	}
+	if ext != "" {
+		tags.Set("type", ext[1:])
+	}
+	in := &s3manager.UploadInput{
+		Bucket:               aws.String(s3s.bucket),
+		Key:                  aws.String(s3s.prefix + name),
+		Body:                 data,
+		ContentType:          aws.String(typ),
+		Metadata:             meta,
+		ServerSideEncryption: s3.ServerSideEncryption(s3s.config.sse),
+		StorageClass:         s3.StorageClass(s3s.config.storageClass),
+		Tagging:              aws.String(tags.Encode()),
 	}
+	if s3s.config.kmsKeyID != "" {
+		in.SSEKMSKeyId = aws.String(s3s.config.kmsKeyID)
+	}
+	return in
+}
+
+func (s3s *s3Storage) Store(name string, data io.Reader, meta Metadata) error {
+	_, err := s3s.upl.Upload(s3s.uploadInput(name, data, meta))
+	return errgo.Mask(err)
+}
+
+// Create stores the object with If-None-Match: *, which S3 refuses with 412
+// Precondition Failed if the object exists. Servers that ignore the header
+// store it anyway.
+func (s3s *s3Storage) Create(name string, data io.Reader, meta Metadata) error {
+	ifNoneMatch := func(r *aws.Request) {
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+	_, err := s3s.upl.Upload(s3s.uploadInput(name, data, meta), s3manager.WithUploaderRequestOptions(ifNoneMatch))
+	if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == http.StatusPreconditionFailed {
+		return errgo.WithCausef(nil, ErrExists, "%v", name)
+	}
+	return errgo.Mask(err)
+}
+
+// ProbeName is the object written to check that the storage is writable,
+// it is under audit/, where the commands do not look for recordings.
+const ProbeName = "audit/probe"
+
+// probe uploads the empty probe object, with the same options as
+// recordings, so that missing permissions, e.g. for the KMS key, are found
+// at startup. The object is overwritten on every start.
+func (s3s *s3Storage) probe() error {
+	return errgo.Mask(s3s.Store(ProbeName, bytes.NewReader(nil), nil))
+}
+
+// Check creates the probe object unless it exists, so we must be allowed to
+// put objects but nothing is written once it does. S3 answers 412 to the
+// conditional put only after checking the permission to put.
+func (s3s *s3Storage) Check() error {
+	err := s3s.Create(ProbeName, bytes.NewReader(nil), nil)
+	if errgo.Cause(err) == ErrExists {
+		return nil
+	}
+	return errgo.Mask(err)
+}
 
-	// Try to upload a dummy data file to make sure it works, if possible
-	// also try to delete it.
-	data := bytes.NewBuffer([]byte("test"))
-	_, err = s3s.upl.Upload(&s3manager.UploadInput{
+func (s3s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	req := s3s.upl.S3.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(s3s.bucket),
-		Key:    aws.String("__testobj"),
-		Body:   data,
+		Key:    aws.String(s3s.prefix + name),
 	})
+	resp, err := req.Send(context.Background())
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, isNotFound)
 	}
+	return resp.Body, nil
+}
 
-	req := s3s.upl.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+// the error of a request for an object that does not exist
+func isNotFound(err error) bool {
+	rf, ok := err.(awserr.RequestFailure)
+	return ok && rf.StatusCode() == http.StatusNotFound
+}
+
+// Metadata reads the metadata stored with the object, with lower case keys
+func (s3s *s3Storage) Metadata(name string) (Metadata, error) {
+	req := s3s.upl.S3.HeadObjectRequest(&s3.HeadObjectInput{
 		Bucket: aws.String(s3s.bucket),
-		Key:    aws.String("__testobj"),
+		Key:    aws.String(s3s.prefix + name),
 	})
-	_, err = req.Send(context.Background())
+	resp, err := req.Send(context.Background())
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-
-	return &s3s, nil
+	meta := Metadata{}
+	for k, v := range resp.Metadata {
+		meta[strings.ToLower(k)] = v
+	}
+	return meta, nil
 }
 
-type s3Storage struct {
-	upl    *s3manager.Uploader
-	bucket string
+func (s3s *s3Storage) Delete(name string) error {
+	req := s3s.upl.S3.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: aws.String(s3s.bucket),
+		Key:    aws.String(s3s.prefix + name),
+	})
+	_, err := req.Send(context.Background())
+	return errgo.Mask(err)
 }
 
-func (s3s *s3Storage) Store(name string, data io.Reader) error {
-	_, err := s3s.upl.Upload(&s3manager.UploadInput{
+func (s3s *s3Storage) List(prefix string) ([]Object, error) {
+	objs := []Object{}
+	req := s3s.upl.S3.ListObjectsV2Request(&s3.ListObjectsV2Input{
 		Bucket: aws.String(s3s.bucket),
-		Key:    aws.String(name),
-		Body:   data,
+		Prefix: aws.String(s3s.prefix + prefix),
 	})
-	return errgo.Mask(err)
+	p := req.Paginate()
+	for p.Next(context.Background()) {
+		for _, o := range p.CurrentPage().Contents {
+			objs = append(objs, Object{
+				Name:     strings.TrimPrefix(aws.StringValue(o.Key), s3s.prefix),
+				Size:     aws.Int64Value(o.Size),
+				Modified: aws.TimeValue(o.LastModified),
+			})
+		}
+	}
+	return objs, errgo.Mask(p.Err())
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/envelope"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+var (
+	globalEncryptionKey *envelope.Key
+	globalDecryptionKey *envelope.Key
+)
+
+// load the keys given by the flags, recordings are encrypted before they
+// are stored with the encryption key, and decrypted when read with the
+// decryption key.
+func setupEncryption() {
+	var err error
+	if fEncryptionKey != "" {
+		if globalEncryptionKey, err = envelope.LoadKey(fEncryptionKey); err != nil {
+			logging.Fatal("error loading encryption key", "error", err)
+		}
+	}
+	if fDecryptionKey != "" {
+		if globalDecryptionKey, err = envelope.LoadKey(fDecryptionKey); err != nil {
+			logging.Fatal("error loading decryption key", "error", err)
+		}
+		if !globalDecryptionKey.CanDecrypt() {
+			logging.Fatal("the decryption key must be a private or master key")
+		}
+	}
+}
+
+// open a recording, decrypting it if it is encrypted
+func openAudio(name string) (io.ReadCloser, error) {
+	rc, err := globalStorage.Open(name)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	r, encrypted, err := envelope.Detect(rc)
+	if err != nil || !encrypted {
+		return readCloser{r, rc}, errgo.Mask(err)
+	}
+	if globalDecryptionKey == nil {
+		rc.Close()
+		return nil, errgo.New(name + " is encrypted, a -decryption-key is needed")
+	}
+	r, err = envelope.Decrypt(r, globalDecryptionKey)
+	if err != nil {
+		rc.Close()
+		return nil, errgo.Mask(err)
+	}
+	return readCloser{r, rc}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// write the decrypted recordings to the output directory, keeping their
+// names, recordings that are not encrypted are copied as they are.
+func runDecrypt() {
+	setupStorage()
+	setupEncryption()
+	if globalDecryptionKey == nil {
+		showError("you must provide a value for the decryption-key flag")
+	}
+	setupAudit()
+
+	objs, err := globalStorage.List(fPrefix)
+	if err != nil {
+		logging.Fatal("error listing storage", "error", err)
+	}
+	n, failed := 0, 0
+	for _, o := range objs {
+		if path.Ext(o.Name) != ".wav" {
+			continue
+		}
+		dst := filepath.Join(fExportDir, filepath.FromSlash(o.Name))
+		if err := decryptAudio(o.Name, dst); err != nil {
+			logging.Error("error decrypting", "name", o.Name, "error", err)
+			failed++
+			continue
+		}
+		entry := audit.Entry{Op: audit.OpDecrypt, Name: o.Name, Detail: map[string]string{"to": dst}}
+		if _, err := globalAudit.Append(entry); err != nil {
+			logging.Fatal("error auditing decryption", "name", o.Name, "error", err)
+		}
+		n++
+	}
+	fmt.Printf("decrypted %v recordings to %v, %v failed\n", n, fExportDir, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// the file is removed on errors, so that a corrupt recording is not
+// mistaken for a good one
+func decryptAudio(name, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	err := exportAudio(name, dst)
+	if err != nil {
+		os.Remove(dst)
+	}
+	return errgo.Mask(err)
+}
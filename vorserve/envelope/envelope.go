@@ -0,0 +1,386 @@
+// Package envelope implements client side envelope encryption of recordings.
+// Each object is encrypted with a fresh AES-256 data key, in chunks sealed
+// with AES-GCM so that it can be streamed, and the data key is wrapped with
+// an RSA public key (RSA-OAEP with SHA-256) or a local AES-256 master key.
+// Only holders of the private or master key can decrypt the object.
+//
+// An encrypted object starts with a header
+//
+//	magic "VORENC" | version 0x00 0x01 | algorithm (1) | key id (8) |
+//	wrapped key length (2) | wrapped key | nonce prefix (7)
+//
+// followed by the chunks, each of ChunkSize plaintext bytes except the last.
+// The nonce of a chunk is the prefix, the big endian chunk number (4) and a
+// byte that is 1 for the last chunk, which detects truncation. The header is
+// the additional data of every chunk.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+
+	"github.com/juju/errgo"
+)
+
+// Scheme names the encryption scheme, it is stored as object metadata.
+const Scheme = "vor-envelope-1"
+
+// ChunkSize is the number of plaintext bytes per chunk.
+const ChunkSize = 64 << 10
+
+var magic = []byte("VORENC\x00\x01")
+
+// the algorithms wrapping the data key
+const (
+	algRSAOAEP byte = 1
+	algMaster  byte = 2
+)
+
+const (
+	keyIDSize  = 8
+	prefixSize = 7
+	tagSize    = 16
+)
+
+// ErrWrongKey is returned when decrypting an object encrypted for another key.
+var ErrWrongKey = errgo.New("object is encrypted with another key")
+
+// A Key wraps and unwraps data keys. A public key can only encrypt.
+type Key struct {
+	pub    *rsa.PublicKey
+	priv   *rsa.PrivateKey
+	master []byte
+}
+
+// LoadKey reads a key from a file, see ParseKey.
+func LoadKey(path string) (*Key, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	k, err := ParseKey(buf)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "bad key in "+path)
+	}
+	return k, nil
+}
+
+// ParseKey parses a PEM encoded RSA public or private key, or a base64
+// encoded 32 byte master key, e.g. created by openssl rand -base64 32.
+func ParseKey(buf []byte) (*Key, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		master, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(buf)))
+		if err != nil || len(master) != 32 {
+			return nil, errgo.New("not a PEM RSA key or a base64 encoded 32 byte master key")
+		}
+		return &Key{master: master}, nil
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rpub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errgo.New("only RSA public keys are supported")
+		}
+		return &Key{pub: rpub}, nil
+	case "RSA PUBLIC KEY":
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return &Key{pub: pub}, nil
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		rpriv, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errgo.New("only RSA private keys are supported")
+		}
+		return &Key{pub: &rpriv.PublicKey, priv: rpriv}, nil
+	case "RSA PRIVATE KEY":
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return &Key{pub: &priv.PublicKey, priv: priv}, nil
+	}
+	return nil, errgo.New("unsupported PEM block " + block.Type)
+}
+
+// CanDecrypt reports whether the key can unwrap data keys.
+func (k *Key) CanDecrypt() bool {
+	return k.priv != nil || k.master != nil
+}
+
+// id identifies the key without revealing it, a public and private
+// key of the same pair have the same id
+func (k *Key) id() []byte {
+	var sum [32]byte
+	if k.master != nil {
+		sum = sha256.Sum256(append([]byte("vor master key "), k.master...))
+	} else {
+		sum = sha256.Sum256(x509.MarshalPKCS1PublicKey(k.pub))
+	}
+	return sum[:keyIDSize]
+}
+
+func (k *Key) wrap(dataKey []byte) (byte, []byte, error) {
+	if k.master == nil {
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k.pub, dataKey, magic)
+		return algRSAOAEP, wrapped, errgo.Mask(err)
+	}
+	aead, err := newGCM(k.master)
+	if err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, errgo.Mask(err)
+	}
+	return algMaster, aead.Seal(nonce, nonce, dataKey, magic), nil
+}
+
+func (k *Key) unwrap(alg byte, wrapped []byte) ([]byte, error) {
+	switch {
+	case alg == algRSAOAEP && k.priv != nil:
+		dataKey, err := rsa.DecryptOAEP(sha256.New(), nil, k.priv, wrapped, magic)
+		return dataKey, errgo.Mask(err)
+	case alg == algMaster && k.master != nil:
+		aead, err := newGCM(k.master)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if len(wrapped) < aead.NonceSize() {
+			return nil, errgo.New("bad wrapped key")
+		}
+		n := aead.NonceSize()
+		dataKey, err := aead.Open(nil, wrapped[:n], wrapped[n:], magic)
+		return dataKey, errgo.Mask(err)
+	}
+	return nil, ErrWrongKey
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errgo.Mask(err)
+}
+
+// Encrypt returns a reader of the encrypted content of r.
+func Encrypt(r io.Reader, k *Key) (io.Reader, error) {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	alg, wrapped, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+
+	header := append([]byte{}, magic...)
+	header = append(header, alg)
+	header = append(header, k.id()...)
+	header = append(header, byte(len(wrapped)>>8), byte(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, prefix...)
+	return &chunker{
+		src:    bufio.NewReaderSize(r, ChunkSize),
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		out:    header,
+		chunk:  make([]byte, ChunkSize),
+	}, nil
+}
+
+// chunker seals the plaintext chunk by chunk as it is read
+type chunker struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	out    []byte
+	chunk  []byte
+	done   bool
+	err    error
+}
+
+func (c *chunker) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		c.next()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *chunker) next() {
+	n, err := io.ReadFull(c.src, c.chunk)
+	switch err {
+	case nil:
+		if _, err := c.src.Peek(1); err == io.EOF {
+			c.done = true
+		} else if err != nil {
+			c.err = err
+			return
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		c.done = true
+	default:
+		c.err = err
+		return
+	}
+	c.out = c.aead.Seal(nil, nonce(c.prefix, c.n, c.done), c.chunk[:n], c.header)
+	c.n++
+}
+
+func nonce(prefix []byte, n uint32, last bool) []byte {
+	buf := make([]byte, 12)
+	copy(buf, prefix)
+	binary.BigEndian.PutUint32(buf[prefixSize:], n)
+	if last {
+		buf[11] = 1
+	}
+	return buf
+}
+
+// Detect reports whether r holds an encrypted object, the returned reader
+// must be used instead of r.
+func Detect(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	buf, err := br.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return br, false, errgo.Mask(err)
+	}
+	return br, bytes.Equal(buf, magic), nil
+}
+
+// Decrypt returns a reader of the decrypted content of r. Reads fail if the
+// content has been changed or truncated.
+func Decrypt(r io.Reader, k *Key) (io.Reader, error) {
+	header := make([]byte, len(magic)+1+keyIDSize+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errgo.Notef(err, "reading header")
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, errgo.New("not encrypted with " + Scheme)
+	}
+	alg := header[len(magic)]
+	id := header[len(magic)+1 : len(magic)+1+keyIDSize]
+	if !bytes.Equal(id, k.id()) {
+		return nil, ErrWrongKey
+	}
+	rest := make([]byte, int(binary.BigEndian.Uint16(header[len(header)-2:]))+prefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, errgo.Notef(err, "reading header")
+	}
+	header = append(header, rest...)
+	wrapped, prefix := rest[:len(rest)-prefixSize], rest[len(rest)-prefixSize:]
+	dataKey, err := k.unwrap(alg, wrapped)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrWrongKey))
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &opener{
+		src:    bufio.NewReaderSize(r, ChunkSize+tagSize),
+		aead:   aead,
+		header: header,
+		prefix: prefix,
+		chunk:  make([]byte, ChunkSize+tagSize),
+	}, nil
+}
+
+// opener opens the sealed chunks as they are read
+type opener struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	out    []byte
+	chunk  []byte
+	done   bool
+	err    error
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.err != nil {
+			return 0, o.err
+		}
+		if o.done {
+			return 0, io.EOF
+		}
+		o.next()
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+func (o *opener) next() {
+	n, err := io.ReadFull(o.src, o.chunk)
+	last := false
+	switch err {
+	case nil:
+		if _, err := o.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			o.err = err
+			return
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		o.err = errgo.New("encrypted object is truncated")
+		return
+	default:
+		o.err = err
+		return
+	}
+	out, err := o.aead.Open(nil, nonce(o.prefix, o.n, last), o.chunk[:n], o.header)
+	if err != nil {
+		o.err = errgo.New("encrypted object is corrupt or truncated")
+		return
+	}
+	o.out, o.done = out, last
+	o.n++
+}
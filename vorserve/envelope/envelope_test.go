@@ -0,0 +1,235 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/juju/errgo"
+)
+
+func masterKey(t *testing.T) *Key {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	k, err := ParseKey([]byte(base64.StdEncoding.EncodeToString(buf) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// a private key and its public key, parsed from PEM
+func rsaKeys(t *testing.T) (*Key, *Key) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kpriv, err := ParseKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kpub, err := ParseKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kpriv, kpub
+}
+
+func randomData(t *testing.T, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func encrypt(t *testing.T, plain []byte, k *Key) []byte {
+	r, err := Encrypt(bytes.NewReader(plain), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func decrypt(enc []byte, k *Key) ([]byte, error) {
+	r, err := Decrypt(bytes.NewReader(enc), k)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	priv, pub := rsaKeys(t)
+	master := masterKey(t)
+	sizes := []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize, 3*ChunkSize + 5}
+	for _, keys := range []struct {
+		name     string
+		enc, dec *Key
+	}{
+		{"rsa", pub, priv},
+		{"master", master, master},
+	} {
+		for _, size := range sizes {
+			plain := randomData(t, size)
+			enc := encrypt(t, plain, keys.enc)
+			r, ok, err := Detect(bytes.NewReader(enc))
+			if err != nil || !ok {
+				t.Fatalf("%v %v: not detected as encrypted: %v", keys.name, size, err)
+			}
+			dec, err := decrypt(mustRead(t, r), keys.dec)
+			if err != nil {
+				t.Fatalf("%v %v: %v", keys.name, size, err)
+			}
+			if !bytes.Equal(dec, plain) {
+				t.Fatalf("%v %v: decrypted content differs", keys.name, size)
+			}
+		}
+	}
+}
+
+func mustRead(t *testing.T, r io.Reader) []byte {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestDetectPlain(t *testing.T) {
+	for _, plain := range [][]byte{nil, []byte("RIFF"), randomData(t, 100)} {
+		if _, ok, err := Detect(bytes.NewReader(plain)); err != nil || ok {
+			t.Errorf("%q detected as encrypted: %v", plain, err)
+		}
+	}
+}
+
+// the length of the header and the data key of an object encrypted with k
+func openHeader(t *testing.T, enc []byte, k *Key) (int, []byte) {
+	n := len(magic) + 1 + keyIDSize
+	wrapped := enc[n+2 : n+2+int(binary.BigEndian.Uint16(enc[n:]))]
+	dataKey, err := k.unwrap(enc[len(magic)], wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n + 2 + len(wrapped) + prefixSize, dataKey
+}
+
+// split the sealed chunks of an object, every chunk but the last is full
+func chunks(enc []byte, headerLen int) [][]byte {
+	res := [][]byte{}
+	for rest := enc[headerLen:]; len(rest) > 0; {
+		n := ChunkSize + tagSize
+		if n > len(rest) {
+			n = len(rest)
+		}
+		res = append(res, rest[:n])
+		rest = rest[n:]
+	}
+	return res
+}
+
+func join(header []byte, chunks ...[]byte) []byte {
+	buf := append([]byte{}, header...)
+	for _, c := range chunks {
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func TestTampering(t *testing.T) {
+	k := masterKey(t)
+	plain := randomData(t, 3*ChunkSize)
+	enc := encrypt(t, plain, k)
+	headerLen, dataKey := openHeader(t, enc, k)
+	header := enc[:headerLen]
+	cs := chunks(enc, headerLen)
+	if len(cs) != 3 {
+		t.Fatalf("expected 3 chunks, got %v", len(cs))
+	}
+
+	// seal chunk i again with the last flag set as given
+	reseal := func(i int, last bool) []byte {
+		aead, err := newGCM(dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := header[headerLen-prefixSize:]
+		chunk, err := aead.Open(nil, nonce(prefix, uint32(i), i == len(cs)-1), cs[i], header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aead.Seal(nil, nonce(prefix, uint32(i), last), chunk, header)
+	}
+	flipped := append([]byte{}, enc...)
+	flipped[len(flipped)-1] ^= 1
+	badHeader := append([]byte{}, enc...)
+	badHeader[headerLen-1] ^= 1
+
+	for _, c := range []struct {
+		name string
+		enc  []byte
+	}{
+		{"truncated at a chunk", join(header, cs[0], cs[1])},
+		{"truncated in a chunk", enc[:len(enc)-100]},
+		{"truncated in the tag", enc[:len(enc)-tagSize+1]},
+		{"only the header", join(header)},
+		{"reordered chunks", join(header, cs[1], cs[0], cs[2])},
+		{"duplicated chunk", join(header, cs[0], cs[0], cs[1], cs[2])},
+		{"chunk after the last", join(header, cs[0], cs[1], cs[2], cs[2])},
+		{"last flag cleared", join(header, cs[0], cs[1], reseal(2, false))},
+		{"last flag set early", join(header, cs[0], reseal(1, true), cs[2])},
+		{"flipped bit", flipped},
+		{"changed header", badHeader},
+	} {
+		dec, err := decrypt(c.enc, k)
+		if err == nil {
+			t.Errorf("%v: decrypted %v bytes", c.name, len(dec))
+		}
+	}
+
+	// the reseal above is correct, so the failures are due to the flags
+	if dec, err := decrypt(join(header, cs[0], cs[1], reseal(2, true)), k); err != nil || !bytes.Equal(dec, plain) {
+		t.Errorf("resealed object does not decrypt: %v", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	priv, pub := rsaKeys(t)
+	otherPriv, _ := rsaKeys(t)
+	master, otherMaster := masterKey(t), masterKey(t)
+	plain := randomData(t, 1000)
+
+	for _, c := range []struct {
+		name     string
+		enc, dec *Key
+	}{
+		{"other master key", master, otherMaster},
+		{"other private key", pub, otherPriv},
+		{"master key for rsa", pub, master},
+		{"private key for master", master, priv},
+		{"public key", pub, pub},
+	} {
+		_, err := decrypt(encrypt(t, plain, c.enc), c.dec)
+		if errgo.Cause(err) != ErrWrongKey {
+			t.Errorf("%v: expected ErrWrongKey, got %v", c.name, err)
+		}
+	}
+}
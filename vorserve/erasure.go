@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// erasureResponse is returned to Twillio Studio when a caller has asked for
+// their recordings to be deleted
+type erasureResponse struct {
+	// Deleted is the number of recordings deleted
+	Deleted int `json:"deleted"`
+	// Held is the number of recordings kept because of a legal hold
+	Held int `json:"held"`
+}
+
+// erasureHandler deletes all recordings of a speaker, identified by the
+// reference code of one of their recordings or else by the calling phone
+// number. It is only served when -erasure-token is set, and the token must
+// be given as the token parameter or a bearer token.
+func erasureHandler(w http.ResponseWriter, r *http.Request) {
+	id := newRequestID()
+	w.Header().Set("X-Request-Id", id)
+	r.ParseForm()
+	l := logging.With("request_id", id, "call_sid", r.FormValue("call_sid"))
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.FormValue("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(fErasureToken)) != 1 {
+		l.Warn("erasure request with a bad token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	phone := r.FormValue("phone")
+	code := normalizeCode(r.FormValue("code"))
+	if phone == "" && code == "" {
+		l.Warn("erasure request without phone number or code")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// all withheld numbers would give the same speaker id
+	caller := ""
+	if !isAnonymous(phone) {
+		caller = generateID(phone)
+	} else if code == "" {
+		l.Warn("erasure by caller id for a withheld number")
+		writeJSONError(w, http.StatusBadRequest, errgo.New("the number is withheld, give the reference code"))
+		return
+	}
+	speaker := caller
+	via := "caller id"
+	if code != "" {
+		var err error
+		if speaker, err = resolveCode(code, caller); err != nil {
+			l.Warn("could not resolve reference code", "error", err)
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		via = "reference code"
+	}
+
+	if !startWork() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer inFlight.Done()
+	resp, err := eraseSpeaker(speaker, map[string]string{
+		"speaker":  speaker,
+		"call_sid": r.FormValue("call_sid"),
+		"via":      via,
+	})
+	if err != nil {
+		l.Error("error erasing recordings", "error", err, "deleted", resp.Deleted)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	l.Info("erased recordings on request", "speaker", speaker, "via", via, "deleted", resp.Deleted, "held", resp.Held)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// the numbers Twillio gives when the caller id is withheld, lower case
+var anonymousNumbers = map[string]bool{
+	"anonymous":    true,
+	"restricted":   true,
+	"private":      true,
+	"unknown":      true,
+	"unavailable":  true,
+	"+266696687":   true, // ANONYMOUS on a keypad
+	"+7378742833":  true, // RESTRICTED
+	"+8656696":     true, // UNKNOWN
+	"+86282452253": true, // UNAVAILABLE
+}
+
+// whether phone does not identify a caller
+func isAnonymous(phone string) bool {
+	p := strings.ToLower(strings.TrimSpace(phone))
+	return p == "" || anonymousNumbers[p] || strings.IndexAny(p, "0123456789") < 0
+}
+
+// the speaker of the recordings with the code, if codes collide the one of
+// the caller is preferred
+func resolveCode(code, caller string) (string, error) {
+	if len(code) != codeDigits {
+		return "", errgo.New("bad reference code")
+	}
+	res, err := globalIndex.Find(index.Query{Code: code, Limit: math.MaxInt32})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	speaker := ""
+	for _, rec := range res.Recordings {
+		if rec.Speaker == caller {
+			return caller, nil
+		}
+		if speaker != "" && speaker != rec.Speaker {
+			return "", errgo.New("reference code is shared by several speakers, call from the phone used")
+		}
+		speaker = rec.Speaker
+	}
+	if speaker == "" {
+		return "", errgo.New("unknown reference code")
+	}
+	return speaker, nil
+}
+
+// delete all recordings of the speaker that are not held, and forget the
+// speaker if none are left
+func eraseSpeaker(speaker string, detail map[string]string) (erasureResponse, error) {
+	resp := erasureResponse{}
+	holds, err := loadLegalHolds()
+	if err != nil {
+		return resp, errgo.NoteMask(err, "error reading legal holds")
+	}
+	res, err := globalIndex.Find(index.Query{Speaker: speaker, Limit: math.MaxInt32})
+	if err != nil {
+		return resp, errgo.Mask(err)
+	}
+	for _, rec := range res.Recordings {
+		if held(rec, holds) {
+			logging.Warn("not erasing recording under legal hold", "name", rec.Name)
+			resp.Held++
+			continue
+		}
+		if _, err := globalAudit.Append(audit.Entry{Op: audit.OpErasure, Name: rec.Name, Detail: detail}); err != nil {
+			return resp, errgo.Mask(err)
+		}
+		if err := deleteRecording(rec); err != nil {
+			return resp, errgo.Mask(err)
+		}
+		resp.Deleted++
+	}
+	if resp.Held == 0 {
+		return resp, errgo.Mask(globalIndex.RemoveSpeaker(speaker))
+	}
+	return resp, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+
+	"github.com/newtechlab/vor/vorgen/config"
+	"github.com/newtechlab/vor/vorgen/flow"
+	"github.com/newtechlab/vor/vorgen/twillio"
+	"github.com/newtechlab/vor/vorserve/index"
+)
+
+const testErasureToken = "0123456789abcdef0123"
+
+// run calls through the flow generated by vorgen against the webhook and
+// erasure endpoints, and check what is deleted
+func TestErasureFlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vorserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fData = "file:" + filepath.Join(dir, "data")
+	fDB = filepath.Join(dir, "vorserve.db")
+	fSalt = "0123456789012345678901234567890123456789"
+	fErasureToken = testErasureToken
+	fLegalHolds = filepath.Join(dir, "holds")
+	if err := ioutil.WriteFile(fLegalHolds, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	setupLayout()
+	setupStorage()
+	setupIndex()
+	defer globalIndex.Close()
+	setupAudit()
+	mux := http.NewServeMux()
+	registerHandlers(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	wavFile := filepath.Join(dir, "answer.wav")
+	writeTestWave(t, wavFile)
+	wavs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, wavFile)
+	}))
+	defer wavs.Close()
+
+	c := config.Default()
+	c.Webhook = srv.URL + "/"
+	c.NumberVariations = 1
+	c.DeletionDigit = "9"
+	c.DeletionKeyword = "slett"
+	c.DeletionToken = testErasureToken
+	c.DeletionDoneMessage = "{deleted} deleted."
+	c.DeletionFailedMessage = "Nothing deleted."
+	project := generateFlow(t, c)
+	c.DeletionToken = "not the erasure token"
+	badTokenProject := generateFlow(t, c)
+
+	call := func(p *twillio.Project, from string, inputs ...string) string {
+		out := &bytes.Buffer{}
+		err := p.Run(twillio.Call{
+			From:              from,
+			CallSid:           "CA" + strings.Trim(from, "+"),
+			Inputs:            inputs,
+			RecordingURL:      wavs.URL + "/answer.wav",
+			RecordingDuration: 2,
+			Out:               out,
+		})
+		if err != nil {
+			t.Fatalf("error running the flow: %v\n%s", err, out)
+		}
+		return out.String()
+	}
+	recordings := func(phone string) []index.Recording {
+		res, err := globalIndex.Find(index.Query{Speaker: generateID(phone), Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Recordings
+	}
+	expect := func(out, want string) {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the call:\n%s", want, out)
+		}
+	}
+
+	const alice, bob, carol = "+4711111111", "+4722222222", "+4733333333"
+	call(project, alice, "say:ja")
+	call(project, alice, "say:ja")
+	call(project, bob, "say:ja")
+	if len(recordings(alice)) != 2 || len(recordings(bob)) != 1 {
+		t.Fatalf("expected 2 and 1 recordings, got %v and %v", len(recordings(alice)), len(recordings(bob)))
+	}
+
+	// a flow with the wrong token is refused
+	out := call(badTokenProject, alice, "dtmf:9#", "dtmf:#", "dtmf:1#")
+	expect(out, "401")
+	expect(out, "Nothing deleted.")
+	if n := len(recordings(alice)); n != 2 {
+		t.Errorf("bad token: expected 2 recordings left, got %v", n)
+	}
+
+	// declining does not call the endpoint
+	out = call(project, alice, "say:slett", "dtmf:#", "say:nei")
+	expect(out, "Nothing deleted.")
+	if strings.Contains(out, "/erasure") {
+		t.Errorf("declined, but the endpoint was called:\n%s", out)
+	}
+	if n := len(recordings(alice)); n != 2 {
+		t.Errorf("declined: expected 2 recordings left, got %v", n)
+	}
+
+	// an unknown code deletes nothing
+	out = call(project, carol, "dtmf:9#", "dtmf:1234567890#", "dtmf:1#")
+	expect(out, "404")
+	expect(out, "Nothing deleted.")
+
+	// the code of bob's recording deletes it, whoever calls
+	code := recordings(bob)[0].Code
+	out = call(project, carol, "dtmf:9#", "dtmf:"+code+"#", "say:ja")
+	expect(out, "1 deleted.")
+	if n := len(recordings(bob)); n != 0 {
+		t.Errorf("by code: expected no recordings left, got %v", n)
+	}
+
+	// a withheld number can not delete by caller id
+	out = call(project, "anonymous", "dtmf:9#", "dtmf:#", "dtmf:1#")
+	expect(out, "400")
+	expect(out, "Nothing deleted.")
+
+	// by caller id, keeping the recording under a legal hold
+	held := recordings(alice)[0].Name
+	if err := ioutil.WriteFile(fLegalHolds, []byte(held+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out = call(project, alice, "dtmf:9#", "dtmf:#", "dtmf:1#")
+	expect(out, `"held": 1`)
+	expect(out, "1 deleted.")
+	if recs := recordings(alice); len(recs) != 1 || recs[0].Name != held {
+		t.Errorf("by caller id: expected only %v left, got %v", held, recs)
+	}
+}
+
+// generate the flow as vorgen does and read it as imported into Studio
+func generateFlow(t *testing.T, c config.Config) *twillio.Project {
+	buf, err := json.Marshal(flow.Generate(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &twillio.Project{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// a two second tone, loud enough to not be silence
+func writeTestWave(t *testing.T, name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const rate = 8000
+	buf := &audio.IntBuffer{
+		Format:         &audio.Format{NumChannels: 1, SampleRate: rate},
+		SourceBitDepth: 16,
+		Data:           make([]int, 2*rate),
+	}
+	for i := range buf.Data {
+		buf.Data[i] = int(8000 * math.Sin(2*math.Pi*440*float64(i)/rate))
+	}
+	enc := wav.NewEncoder(f, rate, 16, 1, 1)
+	if err := enc.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// length of the speaker ids used in the export, a prefix of the
+// generated id. Kaldi needs them to be of equal length to keep the
+// utterances sorted by speaker.
+const exportSpeakerLength = 16
+
+// an utterance is a segment of a recording, the unit of the export
+type utterance struct {
+	ID        string  `json:"id"`
+	Audio     string  `json:"audio_filepath"`
+	Offset    float64 `json:"offset"`
+	Duration  float64 `json:"duration"`
+	Speaker   string  `json:"speaker"`
+	Recording string  `json:"recording"`
+	Session   int     `json:"session"`
+	Split     string  `json:"split,omitempty"`
+}
+
+// export all recordings in the storage as a Kaldi data directory with
+// manifests for other toolkits, the audio is copied to <out>/wav. If
+// splits are requested each also gets a data directory in <out>/<split>.
+func runExport() {
+	sc, err := parseSplitConfig()
+	if err != nil {
+		showError(err.Error())
+	}
+	setupStorage()
+	setupEncryption()
+	setupAudit()
+
+	recs, report, err := scanStorage(map[string]index.Recording{})
+	if err != nil {
+		logging.Fatal("error listing storage", "error", err)
+	}
+	for _, l := range append(report.orphans, report.inconsistent...) {
+		logging.Warn("skipping", "reason", l)
+	}
+
+	wavDir := filepath.Join(fExportDir, "wav")
+	if err := os.MkdirAll(wavDir, 0700); err != nil {
+		logging.Fatal("error creating export directory", "error", err)
+	}
+	wavDir, err = filepath.Abs(wavDir)
+	if err != nil {
+		logging.Fatal("error creating export directory", "error", err)
+	}
+
+	splits := map[string]string{}
+	if !sc.disabled {
+		splits = assignSplits(recs, sc)
+	}
+
+	utts := []utterance{}
+	for _, rec := range recs {
+		if rec.Duration == 0 {
+			continue
+		}
+		id := exportRecordingID(rec)
+		audio := filepath.Join(wavDir, id+".wav")
+		if err := exportAudio(rec.Name, audio); err != nil {
+			logging.Fatal("error exporting", "name", rec.Name, "error", err)
+		}
+		entry := audit.Entry{Op: audit.OpExport, Name: rec.Name, Detail: map[string]string{"to": audio}}
+		if _, err := globalAudit.Append(entry); err != nil {
+			logging.Fatal("error auditing export", "name", rec.Name, "error", err)
+		}
+		for _, u := range recordingUtterances(rec, id, audio) {
+			u.Split = splits[rec.Speaker]
+			utts = append(utts, u)
+		}
+	}
+
+	if err := writeDataset(fExportDir, utts); err != nil {
+		logging.Fatal("error writing export", "error", err)
+	}
+	if !sc.disabled {
+		if err := writeSplits(fExportDir, utts, sc); err != nil {
+			logging.Fatal("error writing splits", "error", err)
+		}
+	}
+	fmt.Printf("exported %v utterances from %v recordings to %v\n", len(utts), len(recs), fExportDir)
+}
+
+func exportSpeakerID(speaker string) string {
+	s := strings.TrimRight(speaker, "=")
+	if len(s) > exportSpeakerLength {
+		s = s[:exportSpeakerLength]
+	}
+	return s
+}
+
+func exportRecordingID(rec index.Recording) string {
+	return exportSpeakerID(rec.Speaker) + "-" + strconv.FormatInt(rec.Stored.UnixNano(), 10)
+}
+
+// one utterance per segment, or the whole recording if the
+// segments are not known.
+func recordingUtterances(rec index.Recording, id, audio string) []utterance {
+	segs := rec.Segments
+	if len(segs) == 0 {
+		segs = []index.Segment{{Start: 0, End: rec.Duration}}
+	}
+	utts := []utterance{}
+	for i, s := range segs {
+		if s.End <= s.Start {
+			continue
+		}
+		utts = append(utts, utterance{
+			ID:        fmt.Sprintf("%v-%03d", id, i),
+			Audio:     audio,
+			Offset:    s.Start,
+			Duration:  s.End - s.Start,
+			Speaker:   exportSpeakerID(rec.Speaker),
+			Recording: id,
+			Session:   rec.Session,
+		})
+	}
+	return utts
+}
+
+func exportAudio(name, dst string) error {
+	r, err := openAudio(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Close())
+}
+
+// write the Kaldi files (wav.scp, segments, utt2spk, spk2utt and utt2dur)
+// and manifest.jsonl and manifest.csv to dir.
+func writeDataset(dir string, utts []utterance) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errgo.Mask(err)
+	}
+	sort.Slice(utts, func(i, j int) bool {
+		return utts[i].ID < utts[j].ID
+	})
+
+	scp := map[string]string{}
+	spk2utt := map[string][]string{}
+	segments, utt2spk, utt2dur := []string{}, []string{}, []string{}
+	for _, u := range utts {
+		scp[u.Recording] = u.Recording + " " + u.Audio
+		spk2utt[u.Speaker] = append(spk2utt[u.Speaker], u.ID)
+		segments = append(segments, fmt.Sprintf("%v %v %.3f %.3f", u.ID, u.Recording, u.Offset, u.Offset+u.Duration))
+		utt2spk = append(utt2spk, u.ID+" "+u.Speaker)
+		utt2dur = append(utt2dur, fmt.Sprintf("%v %.3f", u.ID, u.Duration))
+	}
+	spks := []string{}
+	for spk, ids := range spk2utt {
+		spks = append(spks, spk+" "+strings.Join(ids, " "))
+	}
+	recs := []string{}
+	for _, l := range scp {
+		recs = append(recs, l)
+	}
+
+	files := map[string][]string{
+		"wav.scp":  recs,
+		"segments": segments,
+		"utt2spk":  utt2spk,
+		"spk2utt":  spks,
+		"utt2dur":  utt2dur,
+	}
+	for name, lines := range files {
+		sort.Strings(lines)
+		if err := writeLines(filepath.Join(dir, name), lines); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := writeManifestJSON(filepath.Join(dir, "manifest.jsonl"), utts); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(writeManifestCSV(filepath.Join(dir, "manifest.csv"), utts))
+}
+
+func writeLines(name string, lines []string) error {
+	return writeFile(name, func(w *bufio.Writer) error {
+		for _, l := range lines {
+			if _, err := w.WriteString(l + "\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func writeManifestJSON(name string, utts []utterance) error {
+	return writeFile(name, func(w *bufio.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, u := range utts {
+			if err := enc.Encode(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func writeManifestCSV(name string, utts []utterance) error {
+	return writeFile(name, func(w *bufio.Writer) error {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "audio_filepath", "offset", "duration", "speaker", "recording", "session", "split"})
+		for _, u := range utts {
+			cw.Write([]string{
+				u.ID,
+				u.Audio,
+				strconv.FormatFloat(u.Offset, 'f', 3, 64),
+				strconv.FormatFloat(u.Duration, 'f', 3, 64),
+				u.Speaker,
+				u.Recording,
+				strconv.Itoa(u.Session),
+				u.Split,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+}
+
+func writeFile(name string, fn func(w *bufio.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := fn(w); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := w.Flush(); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(f.Close())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// how long a storage check result is reused, to not hit the
+// storage on every probe from the load balancer
+const storageCheckInterval = 10 * time.Second
+
+var storageCheck struct {
+	sync.Mutex
+	at  time.Time
+	err error
+}
+
+// the health checks are served on their own listener, so that load
+// balancers can reach them without reaching the admin api
+func newHealthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	return mux
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the server can accept recordings, i.e. the
+// storage is writable, there is disk space left for the index and not too
+// many requests are in progress. Details of failures are only logged.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	code := http.StatusOK
+	for name, check := range map[string]func() error{
+		"storage": checkStorage,
+		"disk":    checkDisk,
+		"queue":   checkQueue,
+	} {
+		checks[name] = "ok"
+		if err := check(); err != nil {
+			logging.Warn("readiness check failed", "check", name, "error", err)
+			checks[name] = "failed"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, checks)
+}
+
+func checkStorage() error {
+	storageCheck.Lock()
+	defer storageCheck.Unlock()
+	if time.Since(storageCheck.at) > storageCheckInterval {
+		storageCheck.err = globalStorage.Check()
+		storageCheck.at = time.Now()
+	}
+	return storageCheck.err
+}
+
+func checkDisk() error {
+	free, err := diskFree(filepath.Dir(fDB))
+	if err != nil {
+		// not knowing is not a reason to stop accepting calls
+		return nil
+	}
+	if free >= fMinFree*1024*1024 {
+		return nil
+	}
+	return errgo.New("only " + strconv.FormatUint(free/1024/1024, 10) + " MB free for the index")
+}
+
+func checkQueue() error {
+	if n := int(mInFlight.Value()); fMaxInFlight > 0 && n >= fMaxInFlight {
+		return errgo.New(strconv.Itoa(n) + " requests in progress")
+	}
+	return nil
+}
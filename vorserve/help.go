@@ -4,11 +4,24 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 )
 
 func showHelp() {
 	fmt.Println("vorserve: used to run a VOice Recording SERVEr")
 	fmt.Println("")
+	fmt.Println("usage: vorserve [command] [flags]")
+	fmt.Println("")
+	fmt.Println("without a command the server is started, available commands are:")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-13s %s\n", name, commands[name].help)
+	}
+	fmt.Println("")
 	flag.PrintDefaults()
 	os.Exit(0)
 }
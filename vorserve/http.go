@@ -1,13 +1,57 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
 )
 
-func registerHandlers() {
-	http.HandleFunc("/", twillioHandler)
+// response is returned to Twillio Studio on success, the fields are
+// available in the flow as widgets.<name>.parsed.<field>.
+type response struct {
+	// Session is the number of calls made by the speaker, including this one
+	Session int `json:"session"`
+	// Total is the number of calls each speaker is asked to make
+	Total int `json:"total"`
+	// Remaining is the number of calls left to reach Total
+	Remaining int `json:"remaining"`
+	// Code is the reference code of the recording with spaces between the
+	// digits, the caller can give it to have their data deleted
+	Code string `json:"code"`
+}
+
+func newResponse(rec *index.Recording) response {
+	remaining := fSessions - rec.Session
+	if remaining < 0 {
+		remaining = 0
+	}
+	return response{
+		Session:   rec.Session,
+		Total:     fSessions,
+		Remaining: remaining,
+		Code:      spokenCode(rec.Code),
+	}
+}
+
+// register the public handlers, the server uses http.DefaultServeMux
+func registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/", instrumentHandler(twillioHandler))
+	if fErasureToken != "" {
+		mux.HandleFunc("/erasure", instrumentHandler(erasureHandler))
+	}
 }
 
 func twillioHandler(w http.ResponseWriter, r *http.Request) {
@@ -15,10 +59,17 @@ func twillioHandler(w http.ResponseWriter, r *http.Request) {
 	// found we will simply log and return a bad request. Not
 	// the best practice but good enough for this purpose.
 
+	id := newRequestID()
+	w.Header().Set("X-Request-Id", id)
 	r.ParseForm()
+	l := logging.With("request_id", id, "call_sid", r.FormValue("call_sid"))
+	if up := r.Header.Get("X-Request-Id"); reRequestID.MatchString(up) {
+		l = l.With("upstream_request_id", up)
+	}
+
 	phone := r.FormValue("phone")
 	if phone == "" {
-		log.Println("no phone number was sent")
+		l.Warn("no phone number was sent")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -26,18 +77,119 @@ func twillioHandler(w http.ResponseWriter, r *http.Request) {
 	url := r.FormValue("urls")
 	urls := []string{}
 	if err := json.Unmarshal([]byte(url), &urls); err != nil {
-		log.Println("could not decode json from urls: ", err, urls)
+		// never log the urls themselves, they give access to the recordings
+		l.Warn("could not decode json from urls", "error", err, "length", len(url))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	code := processRequest(phone, urls)
-	w.WriteHeader(code)
+	variation, err := strconv.Atoi(r.FormValue("variation"))
+	if err != nil {
+		variation = -1
+	}
+
+	// only the pseudonymous id and the country code of the
+	// phone number are kept from here on
+	resp, code := processRequest(request{
+		Request: index.Request{
+			ID:         id,
+			Speaker:    generateID(phone),
+			Country:    countryCode(phone),
+			CallSID:    r.FormValue("call_sid"),
+			Variation:  variation,
+			URLs:       urls,
+			Received:   time.Now().UTC(),
+			Consent:    parseConsent(r),
+			ConsentURL: r.FormValue("consent_url"),
+		},
+		log: l,
+	})
+	if code != http.StatusOK {
+		w.WriteHeader(code)
+		return
+	}
+	writeJSON(w, code, resp)
+}
+
+// newRequestID returns a random id used to correlate the log lines of
+// a request, an id set by a proxy is logged alongside it.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
 }
 
-func runServer() {
-	err := http.ListenAndServe(fHTTP, nil)
+var reRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// run the servers until SIGINT or SIGTERM is received, then stop accepting
+// requests and wait for the ones in progress to finish. Requests still not
+// done when the timeout passes are left in the journal for the next start.
+// With TLS the public handlers are served on the HTTPS listener, and the
+// HTTP listener only redirects.
+func runServer(tlsConfig *tls.Config, plain http.Handler) {
+	servers := []*http.Server{{Addr: fHTTP}}
+	if tlsConfig != nil {
+		servers = []*http.Server{
+			{Addr: fHTTPS, TLSConfig: tlsConfig, Handler: strictTransport(http.DefaultServeMux)},
+			{Addr: fHTTP, Handler: plain},
+		}
+	}
+	if fAdmin != "" {
+		servers = append(servers, &http.Server{Addr: fAdmin, Handler: newAdminMux()})
+	}
+	if fHealth != "" {
+		servers = append(servers, &http.Server{Addr: fHealth, Handler: newHealthMux()})
+	}
+	// only the requests left by an earlier run, those received from now
+	// on are journaled too but processed by their handlers
+	pending, err := globalIndex.Requests()
 	if err != nil {
-		log.Fatalln(err)
+		logging.Error("error reading journaled requests", "error", err)
+	}
+	for _, srv := range servers {
+		srv := srv
+		go func() {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				logging.Fatal("error running server", "addr", srv.Addr, "error", err)
+			}
+		}()
+	}
+	go resumeRequests(pending)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	logging.Info("shutting down", "signal", (<-sig).String())
+
+	beginShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), fShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logging.Error("error shutting down server", "addr", srv.Addr, "error", err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		data.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		globalIndex.Close()
+		logging.Info("shut down")
+	case <-ctx.Done():
+		// the index is left open, bolt is safe to abandon and the
+		// unfinished requests are still in the journal
+		logging.Warn("timed out waiting for requests, they are resumed on next start")
+		if n := data.Pending(); n > 0 {
+			logging.Warn("writes to secondaries were not done, run vorserve repair", "pending", n)
+		}
 	}
 }
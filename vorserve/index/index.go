@@ -0,0 +1,235 @@
+// Package index implements a small embedded database keeping track of the
+// speakers and recordings handled by vorserve.
+package index
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errgo"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketSessions   = []byte("sessions")
+	bucketRecordings = []byte("recordings")
+	bucketNames      = []byte("names")
+	bucketRequests   = []byte("requests")
+	bucketMeta       = []byte("meta")
+
+	buckets = [][]byte{bucketSessions, bucketRecordings, bucketNames, bucketRequests, bucketMeta}
+)
+
+// ErrLocked is returned by Open when another process, e.g. the server, has
+// the database open.
+var ErrLocked = errgo.New("the index database is in use by another process")
+
+// An Index is a handle to the embedded database, it is safe for concurrent use.
+type Index struct {
+	db *bolt.DB
+}
+
+// Open opens (or creates) the index database at path.
+func Open(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errgo.WithCausef(nil, ErrLocked, "could not open index database %v", path)
+	}
+	if err != nil {
+		return nil, errgo.NoteMask(err, "could not open index database: "+path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errgo.Mask(err)
+	}
+	return &Index{db: db}, nil
+}
+
+// OpenReadOnly opens the existing index database at path for reading, e.g.
+// to check the storage against it. It fails with ErrLocked while another
+// process, e.g. the server, has the database open.
+func OpenReadOnly(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, errgo.WithCausef(nil, ErrLocked, "could not open index database %v", path)
+	}
+	if err != nil {
+		return nil, errgo.NoteMask(err, "could not open index database: "+path)
+	}
+	return &Index{db: db}, nil
+}
+
+// Close releases the database.
+func (i *Index) Close() error {
+	return errgo.Mask(i.db.Close())
+}
+
+// Reserve increments the session counter of the speaker, sets the session of
+// rec and calls name, which must not block, to name it. The reservation is
+// kept with the journaled request rec is made from, so that a resumed request
+// gets the same session and name rather than counting again. The recording
+// is then stored outside the transaction, and added with Commit or given up
+// with Release.
+func (i *Index) Reserve(rec *Recording, name func(rec *Recording) error) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		reqs := tx.Bucket(bucketRequests)
+		req := Request{}
+		journaled := false
+		if rec.RequestID != "" {
+			if buf := reqs.Get([]byte(rec.RequestID)); buf != nil {
+				if err := json.Unmarshal(buf, &req); err != nil {
+					return errgo.Mask(err)
+				}
+				journaled = true
+			}
+		}
+		if req.Name != "" {
+			rec.Session, rec.Name = req.Session, req.Name
+			return nil
+		}
+
+		b := tx.Bucket(bucketSessions)
+		rec.Session = int(decodeUint(b.Get([]byte(rec.Speaker)))) + 1
+		if err := b.Put([]byte(rec.Speaker), encodeUint(uint64(rec.Session))); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := name(rec); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if !journaled {
+			return nil
+		}
+		req.Session, req.Name = rec.Session, rec.Name
+		buf, err := json.Marshal(req)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(reqs.Put([]byte(req.ID), buf))
+	}), errgo.Any)
+}
+
+// Commit adds the reserved rec to the index and removes the request it was
+// made from.
+func (i *Index) Commit(rec *Recording) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		if rec.RequestID != "" {
+			if err := tx.Bucket(bucketRequests).Delete([]byte(rec.RequestID)); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return errgo.Mask(putRecording(tx, rec))
+	}))
+}
+
+// Release gives up the reservation of rec when it could not be stored, so
+// that a failed recording does not count as a session. The counter is only
+// decremented if no later session of the speaker has been reserved since,
+// the session number is then left unused.
+func (i *Index) Release(rec *Recording) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		reqs := tx.Bucket(bucketRequests)
+		if buf := reqs.Get([]byte(rec.RequestID)); rec.RequestID != "" && buf != nil {
+			req := Request{}
+			if err := json.Unmarshal(buf, &req); err != nil {
+				return errgo.Mask(err)
+			}
+			req.Session, req.Name = 0, ""
+			buf, err := json.Marshal(req)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if err := reqs.Put([]byte(req.ID), buf); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		b := tx.Bucket(bucketSessions)
+		if int(decodeUint(b.Get([]byte(rec.Speaker)))) != rec.Session {
+			return nil
+		}
+		if rec.Session <= 1 {
+			return errgo.Mask(b.Delete([]byte(rec.Speaker)))
+		}
+		return errgo.Mask(b.Put([]byte(rec.Speaker), encodeUint(uint64(rec.Session-1))))
+	}))
+}
+
+// Sessions returns the number of completed sessions of the speaker.
+func (i *Index) Sessions(speaker string) (n int, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		n = int(decodeUint(tx.Bucket(bucketSessions).Get([]byte(speaker))))
+		return nil
+	})
+	return n, errgo.Mask(err)
+}
+
+// RemoveSpeaker forgets the session counter of the speaker, e.g. when all
+// their recordings have been deleted on request.
+func (i *Index) RemoveSpeaker(speaker string) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Delete([]byte(speaker))
+	}))
+}
+
+// SetAuditHead records the sequence number and hash of the last entry of
+// the audit log, so that removing the newest entries can be detected. It
+// is ignored if a later entry has been recorded.
+func (i *Index) SetAuditHead(seq int64, hash string) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		if int64(decodeUint(b.Get([]byte("audit-seq")))) >= seq {
+			return nil
+		}
+		if err := b.Put([]byte("audit-seq"), encodeUint(uint64(seq))); err != nil {
+			return err
+		}
+		return b.Put([]byte("audit-hash"), []byte(hash))
+	}))
+}
+
+// AuditHead returns what SetAuditHead recorded, 0 if nothing.
+func (i *Index) AuditHead() (seq int64, hash string, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		seq = int64(decodeUint(b.Get([]byte("audit-seq"))))
+		hash = string(b.Get([]byte("audit-hash")))
+		return nil
+	})
+	return seq, hash, errgo.Mask(err)
+}
+
+// Salt returns the salt kept in the index, keeping generated first if
+// there is none, so that a generated salt stays the same across restarts.
+func (i *Index) Salt(generated string) (salt string, err error) {
+	err = i.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMeta)
+		if s := b.Get([]byte("salt")); s != nil {
+			salt = string(s)
+			return nil
+		}
+		salt = generated
+		return b.Put([]byte("salt"), []byte(generated))
+	})
+	return salt, errgo.Mask(err)
+}
+
+func encodeUint(v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+
+func decodeUint(buf []byte) uint64 {
+	if len(buf) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf)
+}
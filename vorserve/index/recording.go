@@ -0,0 +1,276 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/juju/errgo"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SchemaVersion is the version of the Recording JSON, it is increased when
+// fields change meaning or are removed.
+const SchemaVersion = 1
+
+// A Recording describes a single stored recording.
+type Recording struct {
+	// Name of the object in the data storage
+	Name string `json:"name"`
+	// Speaker is the pseudonymous id generated from the phone number
+	Speaker string `json:"speaker"`
+	// Country is the calling code of the phone number, e.g. 47
+	Country string `json:"country,omitempty"`
+	// CallSID is the Twillio id of the call, if known
+	CallSID string `json:"call_sid,omitempty"`
+	// RequestID is the id of the webhook request that stored it
+	RequestID string `json:"request_id,omitempty"`
+	// Code is the reference code given to the caller, derived from the name
+	Code string `json:"code,omitempty"`
+	// Session is the number of calls the speaker had made when this was recorded
+	Session int `json:"session"`
+	// Variation is the question sequence used by vorgen, -1 if not known
+	Variation int `json:"variation"`
+	// Duration of the recording in seconds
+	Duration   float64 `json:"duration"`
+	SampleRate int     `json:"sample_rate"`
+	Channels   int     `json:"channels"`
+	BitDepth   int     `json:"bit_depth"`
+	Quality    Quality `json:"quality"`
+	// Segments are the answers making up the recording, if known
+	Segments []Segment `json:"segments,omitempty"`
+	// Encryption is the client side encryption scheme of the audio, if any
+	Encryption string `json:"encryption,omitempty"`
+	// SHA256 is the hex encoded hash of the stored object, as stored, that
+	// is after any encryption
+	SHA256 string `json:"sha256,omitempty"`
+	// Consent is the evidence of the consent given in the call, if sent
+	Consent *Consent `json:"consent,omitempty"`
+	// Received is when the webhook was called, Stored when the file was saved
+	Received time.Time `json:"received"`
+	Stored   time.Time `json:"stored"`
+}
+
+// Consent is what the caller answered when asked for consent.
+type Consent struct {
+	// Version identifies the consent text, as configured in vorgen
+	Version string `json:"version,omitempty"`
+	// Speech is the answer as transcribed by Twillio, Confidence how sure it was
+	Speech     string  `json:"speech"`
+	Confidence float64 `json:"confidence"`
+	// Time is when the consent was given, as sent by Studio
+	Time time.Time `json:"time,omitempty"`
+	// TextHash is the hex encoded SHA-256 of the language and the text the
+	// caller was asked, as generated by vorgen
+	TextHash string `json:"text_hash"`
+	Lang     string `json:"lang,omitempty"`
+	// Recording is the object holding the recorded consent, if any, and
+	// RecordingSHA256 its hash as stored
+	Recording       string `json:"recording,omitempty"`
+	RecordingSHA256 string `json:"recording_sha256,omitempty"`
+}
+
+// Quality holds simple signal metrics computed over a recording.
+type Quality struct {
+	// Peak and RMS levels in dBFS
+	Peak float64 `json:"peak"`
+	RMS  float64 `json:"rms"`
+	// Fraction of samples at full scale
+	Clipping float64 `json:"clipping"`
+	// Fraction of the recording considered silent
+	Silence float64 `json:"silence"`
+}
+
+// A Segment is a part of a recording given in seconds from its start.
+type Segment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// A Query selects recordings from the index, zero values match anything.
+type Query struct {
+	Speaker   string
+	CallSID   string
+	Code      string
+	Variation *int
+	// ConsentVersion, if not nil, matches recordings consented to under that
+	// version, an empty version those without one
+	ConsentVersion *string
+	// Recordings stored in [From, To)
+	From time.Time
+	To   time.Time
+
+	MinDuration float64
+
+	// Pagination of the returned recordings, a Limit of 0 returns none
+	Offset int
+	Limit  int
+}
+
+// A Result summarizes all recordings matching a query and holds the
+// requested page of them, oldest first.
+type Result struct {
+	Total      int         `json:"total"`
+	Speakers   int         `json:"speakers"`
+	Duration   float64     `json:"duration"`
+	Offset     int         `json:"offset"`
+	Recordings []Recording `json:"recordings"`
+}
+
+func (q Query) match(r *Recording) bool {
+	if q.Speaker != "" && q.Speaker != r.Speaker {
+		return false
+	}
+	if q.CallSID != "" && q.CallSID != r.CallSID {
+		return false
+	}
+	if q.Code != "" && q.Code != r.Code {
+		return false
+	}
+	if q.Variation != nil && *q.Variation != r.Variation {
+		return false
+	}
+	if q.ConsentVersion != nil {
+		v := ""
+		if r.Consent != nil {
+			v = r.Consent.Version
+		}
+		if v != *q.ConsentVersion {
+			return false
+		}
+	}
+	return r.Duration >= q.MinDuration
+}
+
+// Find returns the recordings matching q.
+func (i *Index) Find(q Query) (res Result, err error) {
+	res = Result{Offset: q.Offset, Recordings: []Recording{}}
+	speakers := map[string]bool{}
+	err = i.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketRecordings).Cursor()
+		var k, v []byte
+		if q.From.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(timeKey(q.From, ""))
+		}
+		var end []byte
+		if !q.To.IsZero() {
+			end = timeKey(q.To, "")
+		}
+		for ; k != nil; k, v = c.Next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				break
+			}
+			r := Recording{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errgo.Mask(err)
+			}
+			if !q.match(&r) {
+				continue
+			}
+			if res.Total >= q.Offset && len(res.Recordings) < q.Limit {
+				res.Recordings = append(res.Recordings, r)
+			}
+			res.Total++
+			res.Duration += r.Duration
+			speakers[r.Speaker] = true
+		}
+		return nil
+	})
+	res.Speakers = len(speakers)
+	return res, errgo.Mask(err)
+}
+
+// Get returns the recording stored under name.
+func (i *Index) Get(name string) (r Recording, found bool, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		k := tx.Bucket(bucketNames).Get([]byte(name))
+		if k == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(tx.Bucket(bucketRecordings).Get(k), &r)
+	})
+	return r, found, errgo.Mask(err)
+}
+
+// All returns every indexed recording, oldest first.
+func (i *Index) All() ([]Recording, error) {
+	res, err := i.Find(Query{Limit: math.MaxInt32})
+	return res.Recordings, errgo.Mask(err)
+}
+
+// Rebuild replaces all recordings in the index with recs and sets the
+// session counter of each speaker to the highest session found, so that
+// sessions are not numbered again when earlier recordings were deleted.
+func (i *Index) Rebuild(recs []Recording) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketRecordings, bucketNames, bucketSessions} {
+			if err := tx.DeleteBucket(b); err != nil {
+				return errgo.Mask(err)
+			}
+			if _, err := tx.CreateBucket(b); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		sessions := map[string]uint64{}
+		for j := range recs {
+			if err := putRecording(tx, &recs[j]); err != nil {
+				return errgo.Mask(err)
+			}
+			if s := uint64(recs[j].Session); s > sessions[recs[j].Speaker] {
+				sessions[recs[j].Speaker] = s
+			}
+		}
+		b := tx.Bucket(bucketSessions)
+		for speaker, n := range sessions {
+			if err := b.Put([]byte(speaker), encodeUint(n)); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		return nil
+	})
+}
+
+func putRecording(tx *bolt.Tx, r *Recording) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	names := tx.Bucket(bucketNames)
+	recs := tx.Bucket(bucketRecordings)
+	if old := names.Get([]byte(r.Name)); old != nil {
+		if err := recs.Delete(old); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	k := timeKey(r.Stored, r.Name)
+	if err := names.Put([]byte(r.Name), k); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(recs.Put(k, buf))
+}
+
+// recordings are keyed by the time they were stored followed by the
+// name, giving a chronological order and cheap time range queries.
+func timeKey(t time.Time, name string) []byte {
+	return append(encodeUint(uint64(t.UnixNano())), name...)
+}
+
+// Remove removes the recording named name from the index, the session
+// counter of the speaker is not changed.
+func (i *Index) Remove(name string) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(bucketNames)
+		key := names.Get([]byte(name))
+		if key == nil {
+			return nil
+		}
+		if err := tx.Bucket(bucketRecordings).Delete(key); err != nil {
+			return errgo.Mask(err)
+		}
+		return errgo.Mask(names.Delete([]byte(name)))
+	}))
+}
@@ -0,0 +1,71 @@
+package index
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/juju/errgo"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A Request is a webhook request to store a recording. Requests are kept in
+// the index from when they are received until the recording is stored, so
+// that requests interrupted by a shutdown can be processed on the next start.
+type Request struct {
+	ID        string    `json:"id"`
+	Speaker   string    `json:"speaker"`
+	Country   string    `json:"country,omitempty"`
+	CallSID   string    `json:"call_sid,omitempty"`
+	Variation int       `json:"variation"`
+	URLs      []string  `json:"urls"`
+	Received  time.Time `json:"received"`
+	// Consent is sent with the request, ConsentURL is the recorded consent
+	Consent    *Consent `json:"consent,omitempty"`
+	ConsentURL string   `json:"consent_url,omitempty"`
+	// Session and Name are reserved for the recording before it is stored
+	Session int    `json:"session,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+// AddRequest journals a request that is about to be processed.
+func (i *Index) AddRequest(r Request) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRequests).Put([]byte(r.ID), buf)
+	}))
+}
+
+// RemoveRequest removes a request from the journal, requests are also removed
+// when a recording with the same RequestID is added.
+func (i *Index) RemoveRequest(id string) error {
+	return errgo.Mask(i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRequests).Delete([]byte(id))
+	}))
+}
+
+// Requests returns all journaled requests.
+func (i *Index) Requests() (reqs []Request, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRequests).ForEach(func(k, v []byte) error {
+			r := Request{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errgo.Mask(err)
+			}
+			reqs = append(reqs, r)
+			return nil
+		})
+	})
+	return reqs, errgo.Mask(err)
+}
+
+// NumRequests returns the number of requests journaled and not yet removed.
+func (i *Index) NumRequests() (n int, err error) {
+	err = i.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucketRequests).Stats().KeyN
+		return nil
+	})
+	return n, errgo.Mask(err)
+}
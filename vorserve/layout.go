@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// defaultLayout is the flat layout used by earlier versions of vorserve
+const defaultLayout = "{{.SpeakerID}}_{{.Nanos}}.{{.Ext}}"
+
+// layoutFields are available to the -layout template
+type layoutFields struct {
+	SpeakerID string
+	// Nanos is the time the recording was stored in nanoseconds since 1970
+	Nanos int64
+	// Date is the day the recording was stored as 2006-01-02, UTC
+	Date  string
+	Year  string
+	Month string
+	Day   string
+	// CallSID and RequestID are "unknown" if not known
+	CallSID   string
+	RequestID string
+	Session   int
+	Variation int
+	Ext       string
+}
+
+var globalLayout *template.Template
+
+func setupLayout() {
+	var err error
+	if globalLayout, err = parseLayout(fLayout); err != nil {
+		logging.Fatal("bad layout", "error", err)
+	}
+}
+
+// parse the template and check that it gives usable and unique names. The
+// samples only differ in the time stored and the request id, as two
+// requests retried for the same call may, so the layout must include
+// {{.Nanos}} or {{.RequestID}}
+func parseLayout(s string) (*template.Template, error) {
+	t, err := template.New("layout").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	stored := time.Date(2019, 11, 18, 12, 0, 0, 0, time.UTC)
+	a := &index.Recording{Speaker: "speaker", CallSID: "CA1", RequestID: "r1", Session: 1, Stored: stored}
+	b := *a
+	b.RequestID, b.Stored = "r2", stored.Add(time.Nanosecond)
+	na, err := executeLayout(t, a)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	nb, err := executeLayout(t, &b)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if na == nb {
+		return nil, errgo.New("layout does not give unique names, include {{.Nanos}} or {{.RequestID}}")
+	}
+	return t, nil
+}
+
+// recordingName returns the name of the object to store rec in
+func recordingName(rec *index.Recording) (string, error) {
+	return executeLayout(globalLayout, rec)
+}
+
+var reUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_=-]`)
+
+func executeLayout(t *template.Template, rec *index.Recording) (string, error) {
+	safe := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return reUnsafe.ReplaceAllString(s, "_")
+	}
+	f := layoutFields{
+		SpeakerID: rec.Speaker,
+		Nanos:     rec.Stored.UnixNano(),
+		Date:      rec.Stored.Format("2006-01-02"),
+		Year:      rec.Stored.Format("2006"),
+		Month:     rec.Stored.Format("01"),
+		Day:       rec.Stored.Format("02"),
+		CallSID:   safe(rec.CallSID),
+		RequestID: safe(rec.RequestID),
+		Session:   rec.Session,
+		Variation: rec.Variation,
+		Ext:       "wav",
+	}
+	b := &strings.Builder{}
+	if err := t.Execute(b, f); err != nil {
+		return "", errgo.Mask(err)
+	}
+	name := b.String()
+	if !strings.HasSuffix(name, ".wav") {
+		return "", errgo.New("layout must end with .{{.Ext}}: " + name)
+	}
+	if strings.HasSuffix(name, consentSuffix) {
+		return "", errgo.New("layout must not give names ending with " + consentSuffix)
+	}
+	if strings.HasPrefix(name, auditPrefix) {
+		return "", errgo.New("layout must not give names starting with " + auditPrefix)
+	}
+	if len(name) > 1024 {
+		return "", errgo.New("name longer than 1024 bytes: " + name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) {
+			return "", errgo.New("layout must give relative names without empty, . or .. parts: " + name)
+		}
+	}
+	return name, nil
+}
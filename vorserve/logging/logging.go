@@ -0,0 +1,207 @@
+// Package logging implements leveled, structured logging for vorserve. Each
+// line carries a message and key value pairs, written either as JSON or as
+// plain text. Values are scrubbed of anything looking like a URL or a phone
+// number, since those must never end up in the logs.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errgo"
+)
+
+// A Level is the severity of a log line.
+type Level int
+
+// The supported levels, in increasing severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if n == s {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errgo.New("unknown log level " + s + ", accepted options are: " + strings.Join(levelNames, ", "))
+}
+
+var (
+	mu     sync.Mutex
+	out    io.Writer = os.Stderr
+	level            = LevelInfo
+	asJSON           = true
+)
+
+// Configure sets the minimum level logged and the format, json or text.
+func Configure(lvl, format string, w io.Writer) error {
+	l, err := ParseLevel(lvl)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if format != "json" && format != "text" {
+		return errgo.New("unknown log format " + format + ", accepted options are: json, text")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	level, asJSON, out = l, format == "json", w
+	return nil
+}
+
+var (
+	reURL   = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"']+`)
+	rePhone = regexp.MustCompile(`\+[0-9][0-9 ()-]{5,}[0-9]`)
+)
+
+// Scrub replaces URLs and phone numbers in s.
+func Scrub(s string) string {
+	s = reURL.ReplaceAllString(s, "[url]")
+	return rePhone.ReplaceAllString(s, "[number]")
+}
+
+// A Logger writes log lines carrying its fields.
+type Logger struct {
+	fields []interface{}
+}
+
+var root = &Logger{}
+
+// With returns a logger adding the key value pairs to each line.
+func With(kv ...interface{}) *Logger {
+	return root.With(kv...)
+}
+
+// With returns a logger adding the key value pairs to each line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{fields: append(fields, kv...)}
+}
+
+// Debug logs msg at the debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs msg at the info level.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs msg at the warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs msg at the error level.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal logs msg at the error level and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// Debug logs msg at the debug level.
+func Debug(msg string, kv ...interface{}) { root.log(LevelDebug, msg, kv) }
+
+// Info logs msg at the info level.
+func Info(msg string, kv ...interface{}) { root.log(LevelInfo, msg, kv) }
+
+// Warn logs msg at the warn level.
+func Warn(msg string, kv ...interface{}) { root.log(LevelWarn, msg, kv) }
+
+// Error logs msg at the error level.
+func Error(msg string, kv ...interface{}) { root.log(LevelError, msg, kv) }
+
+// Fatal logs msg at the error level and exits.
+func Fatal(msg string, kv ...interface{}) {
+	root.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if lvl < level {
+		return
+	}
+
+	caller := ""
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	fields := map[string]interface{}{}
+	all := append(append([]interface{}{}, l.fields...), kv...)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		if i+1 == len(all) {
+			fields["!badkey"] = key
+			break
+		}
+		fields[key] = value(all[i+1])
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	msg = Scrub(msg)
+
+	if asJSON {
+		fields["time"] = now
+		fields["level"] = lvl.String()
+		fields["msg"] = msg
+		fields["caller"] = caller
+		buf, err := json.Marshal(fields)
+		if err != nil {
+			buf = []byte(`{"level":"error","msg":"could not encode log line"}`)
+		}
+		out.Write(append(buf, '\n'))
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%v %-5v %v %v", now, lvl, caller, msg)
+	for _, k := range keys {
+		fmt.Fprintf(b, " %v=%v", k, strconv.Quote(fmt.Sprint(fields[k])))
+	}
+	b.WriteString("\n")
+	io.WriteString(out, b.String())
+}
+
+// values are scrubbed, errors are logged as their message. Numbers and
+// booleans, which can not hold a url or a +number, are kept, any other
+// value, e.g. url.Values or a struct, is logged as printed by fmt.
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return Scrub(t.Error())
+	case string:
+		return Scrub(t)
+	case fmt.Stringer:
+		return Scrub(t.String())
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	}
+	return Scrub(fmt.Sprint(v))
+}
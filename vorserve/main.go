@@ -4,62 +4,225 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"flag"
-	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
 )
 
 var (
-	fHelp bool
-	fHTTP string
-	fData string
-	fSalt string
+	fHelp        bool
+	fHTTP        string
+	fAdmin       string
+	fHealth      string
+	fData        string
+	fSalt        string
+	fDB          string
+	fSessions    int
+	fMinFree     uint64
+	fMaxInFlight int
+	fDryRun      bool
+	fExportDir   string
+	fSplit       string
+	fSplitSeed   string
+	fStratify    string
+	fTrials      int
+	fLogLevel    string
+	fLogFormat   string
+
+	fShutdownTimeout time.Duration
+	fHTTPS           string
+	fTLSCert         string
+	fTLSKey          string
+	fACMEDomains     string
+	fACMECache       string
+	fACMEEmail       string
+	fConfig          string
+	fDumpConfig      bool
+	fEncryptionKey   string
+	fDecryptionKey   string
+	fPrefix          string
+	fLayout          string
+
+	fRetention         string
+	fRetentionInterval time.Duration
+	fLegalHolds        string
+	fAuditLog          string
+
+	fFrom         string
+	fTo           string
+	fConcurrency  int
+	fDeleteSource bool
+	fErasureToken string
 )
 
 var (
 	globalStorage data.Storage
+	globalIndex   *index.Index
 )
 
 func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
 	flag.BoolVar(&fHelp, "h", false, "show this information")
+	flag.StringVar(&fConfig, "config", "", "YAML config file, settings are named as the flags")
+	flag.BoolVar(&fDumpConfig, "dump-config", false, "dump an annotated config file with the defaults")
 	flag.StringVar(&fHTTP, "http", ":5000", "interface and port to bind to")
-	flag.StringVar(&fData, "data", "", "data storage path, supports local folder or S3 bucket, formatted as s3:bucketname or file:path")
-	flag.StringVar(&fSalt, "salt", "", "salt to use, if not specified a random one is used")
+	flag.StringVar(&fData, "data", "", "data storage path, supports local folder or S3 bucket, formatted as file:path, s3:bucketname or s3://bucketname/prefix?endpoint=url&path_style=true&region=name, or replicate:all|quorum|primary;spec;spec... to write to several")
+	flag.StringVar(&fHTTPS, "https", ":443", "interface and port to serve HTTPS on, when a certificate or acme is configured")
+	flag.StringVar(&fTLSCert, "tls-cert", "", "PEM certificate (chain) file, to terminate TLS with a static certificate")
+	flag.StringVar(&fTLSKey, "tls-key", "", "PEM private key file of the certificate")
+	flag.StringVar(&fACMEDomains, "acme-domains", "", "comma separated domains to get certificates for from Let's Encrypt, -http must then be on port 80")
+	flag.StringVar(&fACMECache, "acme-cache", "./acme", "directory to keep acme certificates and account key in")
+	flag.StringVar(&fACMEEmail, "acme-email", "", "contact email given to Let's Encrypt, optional")
+	flag.StringVar(&fSalt, "salt", "", "salt to use, if not specified a random one is generated on the first start and kept in the index (-db)")
+	flag.StringVar(&fLogLevel, "log-level", "info", "minimum level to log, debug, info, warn or error")
+	flag.StringVar(&fLogFormat, "log-format", "json", "format of the log lines, json or text")
+	flag.StringVar(&fEncryptionKey, "encryption-key", "", "RSA public key (PEM) or base64 master key file, recordings are encrypted with before they are stored")
+	flag.StringVar(&fDecryptionKey, "decryption-key", "", "RSA private key (PEM) or base64 master key file, to read encrypted recordings")
+	flag.StringVar(&fPrefix, "prefix", "", "commands only handle objects with names starting with this")
+	flag.StringVar(&fLayout, "layout", defaultLayout, "template of the names recordings are stored under, see the README for the fields")
+	flag.StringVar(&fRetention, "retention", "", "how long recordings are kept, e.g. 24m or 24m,test/=30d for a period per name prefix, in d, w, m or y, empty keeps them forever")
+	flag.DurationVar(&fRetentionInterval, "retention-interval", 24*time.Hour, "how often the server deletes expired recordings, 0 to only do it with the retention command")
+	flag.StringVar(&fLegalHolds, "legal-holds", "", "file of speaker ids or name prefixes, one per line, exempt from retention")
+	flag.StringVar(&fAuditLog, "audit-log", "", "data storage to keep the audit log in, as -data, by default the -data storage under audit/log/")
+	flag.StringVar(&fFrom, "from", "", "data storage the migrate command copies from, as -data")
+	flag.StringVar(&fTo, "to", "", "data storage the migrate command copies to, as -data")
+	flag.IntVar(&fConcurrency, "concurrency", 8, "number of objects the migrate command copies at the same time")
+	flag.BoolVar(&fDeleteSource, "delete-source", false, "delete the objects from the -from storage once copied and verified")
+	flag.StringVar(&fErasureToken, "erasure-token", "", "secret the vorgen deletion branch authenticates with, enables the /erasure endpoint, empty to disable")
+	flag.StringVar(&fDB, "db", "./vorserve.db", "path to the local index database")
+	flag.StringVar(&fAdmin, "admin", "localhost:5001", "interface and port of the admin api, never expose it publicly, empty to disable")
+	flag.StringVar(&fHealth, "health", "localhost:5002", "interface and port of /healthz and /readyz, for load balancers, empty to disable")
+	flag.DurationVar(&fShutdownTimeout, "shutdown-timeout", 2*time.Minute, "how long to wait for requests in progress when shutting down")
+	flag.IntVar(&fSessions, "sessions", 3, "number of calls each speaker is asked to make")
+	flag.Uint64Var(&fMinFree, "min-free", 100, "MB of free disk space needed next to the index to be ready")
+	flag.IntVar(&fMaxInFlight, "max-in-flight", 100, "number of requests in progress above which the server is not ready, 0 for no limit")
+	flag.BoolVar(&fDryRun, "dry-run", false, "commands only report what they would change")
+	flag.StringVar(&fExportDir, "out", "./export", "directory to write the export to")
+	flag.StringVar(&fSplit, "split", "", "export speaker disjoint train,validation,test splits with these ratios, e.g. 80,10,10")
+	flag.StringVar(&fSplitSeed, "seed", "vor", "seed used to assign speakers to splits")
+	flag.StringVar(&fStratify, "stratify", "", "balance the splits by session count and/or country code, e.g. session,country")
+	flag.IntVar(&fTrials, "trials", 10000, "maximum number of target and of non target trials per split")
+}
+
+// commands that can be given as the first argument, e.g. vorserve reindex -data ...,
+// without a command the server is started.
+var commands = map[string]struct {
+	run  func()
+	help string
+}{
+	"reindex":      {runReindex, "rebuild the index database from the contents of the data storage"},
+	"export":       {runExport, "export the recordings as a Kaldi data directory with JSONL and CSV manifests"},
+	"decrypt":      {runDecrypt, "write the decrypted recordings to the -out directory"},
+	"retention":    {runRetention, "delete the recordings older than the retention period"},
+	"repair":       {runRepair, "copy objects missing in some backends of a replicated storage from the others"},
+	"migrate":      {runMigrate, "copy all objects from the -from to the -to data storage"},
+	"verify":       {runVerify, "check the stored recordings against their hashes and wave headers"},
+	"audit verify": {runAuditVerify, "check that the audit log has not been changed"},
 }
 
 func main() {
-	flag.Parse()
+	cmd := parseArgs()
 
 	if fHelp {
 		showHelp()
 	}
-	if fData == "" {
+	if fDumpConfig {
+		showConfig()
+	}
+	if err := loadConfig(); err != nil {
+		showError(err.Error())
+	}
+	if err := logging.Configure(fLogLevel, fLogFormat, os.Stderr); err != nil {
+		showError(err.Error())
+	}
+	if fData == "" && cmd != "migrate" {
 		showError("you must provide a value for the data flag")
 	}
-	if fSalt == "" {
-		// initiate a random salt that will be used
-		buf := make([]byte, 512/8)
-		n, err := rand.Read(buf)
-		if n != 512/8 || err != nil {
-			log.Fatalln("error reading random data: ", err, n)
+	if cmd == "" {
+		serve()
+		return
+	}
+	c, ok := commands[cmd]
+	if !ok {
+		showError("unknown command: " + cmd)
+	}
+	c.run()
+	// the replicas written in the background
+	data.Wait()
+}
+
+// parse the flags, which may be preceded by a command of one or two words
+func parseArgs() string {
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		flag.Parse()
+		return ""
+	}
+	if len(os.Args) > 2 {
+		if _, ok := commands[os.Args[1]+" "+os.Args[2]]; ok {
+			flag.CommandLine.Parse(os.Args[3:])
+			return os.Args[1] + " " + os.Args[2]
 		}
-		fSalt = base64.StdEncoding.EncodeToString(buf)
 	}
-	if len(fSalt) < 32 {
-		log.Fatalln("to short a salt, must be at least 32 characters long")
+	flag.CommandLine.Parse(os.Args[2:])
+	return os.Args[1]
+}
+
+func serve() {
+	if fSalt != "" && len(fSalt) < 32 {
+		logging.Fatal("to short a salt, must be at least 32 characters long")
+	}
+
+	if fErasureToken != "" && len(fErasureToken) < 16 {
+		logging.Fatal("to short an erasure token, must be at least 16 characters long")
 	}
 
+	tlsConfig, plain := setupTLS()
+	setupEncryption()
+	setupLayout()
+	if _, err := parseRetention(fRetention); err != nil {
+		logging.Fatal("bad retention", "error", err)
+	}
 	setupStorage()
-	registerHandlers()
-	runServer()
+	setupIndex()
+	setupSalt()
+	setupAudit()
+	go runRetentionSweeper()
+	registerHandlers(http.DefaultServeMux)
+	runServer(tlsConfig, plain)
 }
 
 func setupStorage() {
 	var err error
 	globalStorage, err = data.NewStorage(fData)
 	if err != nil {
-		log.Fatalln("error creating data storage: ", err)
+		logging.Fatal("error creating data storage", "error", err)
+	}
+}
+
+// without -salt a random salt is generated on the first start and kept in
+// the index, so that speakers keep their ids, and counters, on restarts
+func setupSalt() {
+	if fSalt != "" {
+		return
+	}
+	buf := make([]byte, 512/8)
+	n, err := rand.Read(buf)
+	if n != 512/8 || err != nil {
+		logging.Fatal("error reading random data", "error", err, "read", n)
+	}
+	if fSalt, err = globalIndex.Salt(base64.StdEncoding.EncodeToString(buf)); err != nil {
+		logging.Fatal("error reading salt from index", "error", err)
+	}
+}
+
+func setupIndex() {
+	var err error
+	globalIndex, err = index.Open(fDB)
+	if err != nil {
+		logging.Fatal("error opening index", "error", err)
 	}
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/newtechlab/vor/vorserve/metrics"
+)
+
+var (
+	mRequests = metrics.NewCounter("vorserve_requests_total",
+		"Webhook and erasure requests by response status code.", "code")
+	mStageDuration = metrics.NewHistogram("vorserve_stage_duration_seconds",
+		"Time spent in each processing stage.", metrics.DefaultBuckets, "stage")
+	mStoredBytes = metrics.NewCounter("vorserve_stored_bytes_total",
+		"Bytes of recordings stored.")
+	mStoredSeconds = metrics.NewCounter("vorserve_stored_audio_seconds_total",
+		"Seconds of audio stored.")
+	mDownloadFailures = metrics.NewCounter("vorserve_download_failures_total",
+		"Failed recording downloads by reason.", "reason")
+	mInFlight = metrics.NewGauge("vorserve_requests_in_flight",
+		"Webhook and erasure requests currently being processed.")
+	mQueued = metrics.NewGaugeFunc("vorserve_requests_queued",
+		"Requests journaled and not yet stored, including those waiting to be resumed after a restart.",
+		queueDepth)
+)
+
+// the number of journaled requests, -1 if it can not be read
+func queueDepth() float64 {
+	if globalIndex == nil {
+		return 0
+	}
+	n, err := globalIndex.NumRequests()
+	if err != nil {
+		return -1
+	}
+	return float64(n)
+}
+
+func init() {
+	mInFlight.Set(0)
+}
+
+// record the time spent in a processing stage since start
+func observeStage(stage string, start time.Time) {
+	mStageDuration.Observe(time.Since(start).Seconds(), stage)
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// count the requests and the ones in flight
+func instrumentHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mInFlight.Add(1)
+		defer mInFlight.Add(-1)
+		rec := &statusRecorder{w, http.StatusOK}
+		h(rec, r)
+		mRequests.Inc(strconv.Itoa(rec.code))
+	}
+}
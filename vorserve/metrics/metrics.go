@@ -0,0 +1,247 @@
+// Package metrics implements the few Prometheus metric types needed by vorserve
+// and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets in seconds suitable for request stages.
+var DefaultBuckets = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	mu      sync.Mutex
+	metrics []metric
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// values for each combination of label values
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labels  string
+	v       float64
+	buckets []uint64
+	count   uint64
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{name: name, help: help, typ: typ, labels: labels, values: map[string]*value{}}
+}
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	metrics = append(metrics, m)
+}
+
+// get the value for the label values, must be called holding v.mu
+func (v *vec) get(lvs []string) *value {
+	if len(lvs) != len(v.labels) {
+		panic("metrics: " + v.name + " expects labels " + strings.Join(v.labels, ","))
+	}
+	key := strings.Join(lvs, "\xff")
+	val, ok := v.values[key]
+	if !ok {
+		pairs := make([]string, len(lvs))
+		for i := range lvs {
+			pairs[i] = v.labels[i] + "=" + quoteLabel(lvs[i])
+		}
+		val = &value{labels: strings.Join(pairs, ",")}
+		v.values[key] = val
+	}
+	return val
+}
+
+// the text format only escapes backslash, double quote and newline in
+// label values, other characters are written as they are
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func (v *vec) header(w *bufio.Writer) []*value {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", v.name, v.help, v.name, v.typ)
+	vals := make([]*value, 0, len(v.values))
+	for _, val := range v.values {
+		vals = append(vals, val)
+	}
+	sort.Slice(vals, func(i, j int) bool { return vals[i].labels < vals[j].labels })
+	return vals
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, val := range v.header(w) {
+		fmt.Fprintf(w, "%v%v %v\n", v.name, braces(val.labels), formatFloat(val.v))
+	}
+}
+
+// A Counter is a value that only increases.
+type Counter struct{ *vec }
+
+// NewCounter creates and registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	register(c)
+	return c
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.get(labelValues).v += v
+	c.mu.Unlock()
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// A Gauge is a value that can go up and down.
+type Gauge struct{ *vec }
+
+// NewGauge creates and registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues).v = v
+	g.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the gauge.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mu.Lock()
+	g.get(labelValues).v += v
+	g.mu.Unlock()
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.get(labelValues).v
+}
+
+// A GaugeFunc is a gauge without labels whose value is read when the
+// metrics are served.
+type GaugeFunc struct {
+	name, help string
+	f          func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge with the value returned by f.
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{name, help, f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(w, "%v %v\n", g.name, formatFloat(g.f()))
+}
+
+// A Histogram counts observations in buckets.
+type Histogram struct {
+	*vec
+	bounds []float64
+}
+
+// NewHistogram creates and registers a histogram with the given upper bucket
+// bounds, in increasing order, and label names.
+func NewHistogram(name, help string, bounds []float64, labels ...string) *Histogram {
+	h := &Histogram{newVec(name, help, "histogram", labels), bounds}
+	register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	val := h.get(labelValues)
+	if val.buckets == nil {
+		val.buckets = make([]uint64, len(h.bounds))
+	}
+	for i, b := range h.bounds {
+		if v <= b {
+			val.buckets[i]++
+		}
+	}
+	val.count++
+	val.v += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, val := range h.header(w) {
+		sep := ""
+		if val.labels != "" {
+			sep = ","
+		}
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%v_bucket{%v%vle=%q} %v\n", h.name, val.labels, sep, formatFloat(b), val.buckets[i])
+		}
+		fmt.Fprintf(w, "%v_bucket{%v%vle=\"+Inf\"} %v\n", h.name, val.labels, sep, val.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, braces(val.labels), formatFloat(val.v))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, braces(val.labels), val.count)
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		mu.Lock()
+		ms := metrics
+		mu.Unlock()
+		for _, m := range ms {
+			m.write(bw)
+		}
+		bw.Flush()
+	})
+}
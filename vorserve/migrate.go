@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// what happened to the objects migrated
+type migrateReport struct {
+	mu sync.Mutex
+	// copied and verified
+	copied []string
+	// already in the destination with the same content
+	present []string
+	failed  []string
+	deleted int
+}
+
+func (r *migrateReport) add(list *[]string, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*list = append(*list, line)
+}
+
+// copy all objects from the -from storage to the -to storage, checking that
+// each copy reads back with the same hash. Objects already copied are
+// skipped, so an interrupted migration is resumed by running it again.
+// With -delete-source the objects are deleted from -from once verified.
+// The audit log is migrated first, then every copy and deletion is logged
+// to it, in -to unless -audit-log is given.
+func runMigrate() {
+	if fFrom == "" || fTo == "" {
+		showError("you must provide values for the from and to flags")
+	}
+	if fConcurrency < 1 {
+		showError("concurrency must be at least 1")
+	}
+	from, err := data.NewStorage(fFrom)
+	if err != nil {
+		logging.Fatal("error creating source storage", "error", err)
+	}
+	to, err := data.NewStorage(fTo)
+	if err != nil {
+		logging.Fatal("error creating destination storage", "error", err)
+	}
+	if err := to.Check(); err != nil {
+		logging.Fatal("destination storage check failed", "error", err)
+	}
+
+	objs, err := from.List(fPrefix)
+	if err != nil {
+		logging.Fatal("error listing source storage", "error", err)
+	}
+	dst, err := to.List(fPrefix)
+	if err != nil {
+		logging.Fatal("error listing destination storage", "error", err)
+	}
+	sizes := map[string]int64{}
+	for _, o := range dst {
+		sizes[o.Name] = o.Size
+	}
+
+	// a recording is migrated together with its sidecar, which gives the
+	// metadata of all, and its recorded consent
+	groups := map[string][]data.Object{}
+	for _, o := range objs {
+		key := o.Name
+		switch {
+		case strings.HasPrefix(key, auditPrefix):
+		case path.Ext(key) == ".json":
+			key = strings.TrimSuffix(key, ".json") + ".wav"
+		case strings.HasSuffix(key, consentSuffix):
+			key = consentOf(key)
+		}
+		groups[key] = append(groups[key], o)
+	}
+	audited, keys := []string{}, []string{}
+	for k := range groups {
+		if strings.HasPrefix(k, auditPrefix) {
+			audited = append(audited, k)
+		} else {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(audited)
+	sort.Strings(keys)
+
+	report := &migrateReport{}
+	migrateGroups(from, to, groups, audited, sizes, report)
+	if len(report.failed) > 0 {
+		logging.Fatal("error migrating the audit log", "error", report.failed[0])
+	}
+	if !fDryRun {
+		globalStorage = to
+		l, err := audit.Open(auditStorage(), auditLogPrefix)
+		if err != nil {
+			logging.Fatal("error opening audit log", "error", err)
+		}
+		globalAudit = l
+	}
+	migrateGroups(from, to, groups, keys, sizes, report)
+
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"copied", report.copied},
+		{"failed", report.failed},
+	}
+	if fDryRun {
+		sections[0].title = "would copy"
+	}
+	for _, s := range sections {
+		if len(s.lines) == 0 {
+			continue
+		}
+		sort.Strings(s.lines)
+		fmt.Printf("%v (%v):\n", s.title, len(s.lines))
+		for _, l := range s.lines {
+			fmt.Println("  " + l)
+		}
+	}
+	fmt.Printf("%v copied, %v already migrated, %v failed, %v deleted from source\n",
+		len(report.copied), len(report.present), len(report.failed), report.deleted)
+	if fDryRun {
+		fmt.Println("dry run, nothing copied")
+	}
+	if len(report.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// migrate the groups with the given keys, -concurrency at a time
+func migrateGroups(from, to data.Storage, groups map[string][]data.Object, keys []string, sizes map[string]int64, report *migrateReport) {
+	work := make(chan []data.Object)
+	wg := sync.WaitGroup{}
+	for i := 0; i < fConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range work {
+				migrateGroup(from, to, g, sizes, report)
+			}
+		}()
+	}
+	for _, k := range keys {
+		work <- groups[k]
+	}
+	close(work)
+	wg.Wait()
+}
+
+// migrate a recording and its sidecar, or any other object, the sidecar
+// last so that it is not deleted before the recording is migrated
+func migrateGroup(from, to data.Storage, objs []data.Object, sizes map[string]int64, report *migrateReport) {
+	sort.Slice(objs, func(i, j int) bool {
+		return path.Ext(objs[i].Name) != ".json" && path.Ext(objs[j].Name) == ".json"
+	})
+	for _, o := range objs {
+		if fDryRun {
+			if size, ok := sizes[o.Name]; !ok || size != o.Size {
+				report.add(&report.copied, o.Name)
+			}
+			continue
+		}
+		copied, err := migrateObject(from, to, o, sizes)
+		if err != nil {
+			report.add(&report.failed, o.Name+": "+err.Error())
+			// keep the sidecar of a recording that failed
+			return
+		}
+		if copied {
+			report.add(&report.copied, o.Name)
+		} else {
+			report.add(&report.present, o.Name)
+		}
+		if fDeleteSource {
+			if err := auditMigration(audit.Entry{Op: audit.OpDelete, Name: o.Name}); err != nil {
+				report.add(&report.failed, o.Name+": copied, but not deleted from source: "+err.Error())
+				return
+			}
+			if err := from.Delete(o.Name); err != nil {
+				report.add(&report.failed, o.Name+": copied, but not deleted from source: "+err.Error())
+				return
+			}
+			report.mu.Lock()
+			report.deleted++
+			report.mu.Unlock()
+		}
+	}
+}
+
+// copy the object unless the destination has it already, and check that
+// the destination then has the same content as the source. The metadata is
+// copied from the source, or from the sidecar if the source does not keep
+// it, as by repair.
+func migrateObject(from, to data.Storage, o data.Object, sizes map[string]int64) (bool, error) {
+	buf, err := readObject(from, o.Name)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+
+	copied := false
+	if size, ok := sizes[o.Name]; !ok || size != int64(len(buf)) || !sameHash(to, o.Name, hash) {
+		src, err := data.ReadMetadata(from, o.Name)
+		if err != nil {
+			return false, errgo.NoteMask(err, "error reading metadata")
+		}
+		if len(src) == 0 {
+			src = repairMetadata(from, o.Name)
+		}
+		meta := data.Metadata{}
+		for k, v := range src {
+			meta[k] = v
+		}
+		if h, ok := meta["sha256"]; ok && h != hash {
+			return false, errgo.New("the content does not match the sha256 of the source, not copied")
+		}
+		meta["sha256"] = hash
+		if err := to.Store(o.Name, bytes.NewReader(buf), meta); err != nil {
+			return false, errgo.Mask(err)
+		}
+		copied = true
+		if !sameHash(to, o.Name, hash) {
+			return false, errgo.New("copy does not have the same content")
+		}
+		entry := audit.Entry{Op: audit.OpStore, Name: o.Name, Size: int64(len(buf)), SHA256: hash}
+		if err := auditMigration(entry); err != nil {
+			return false, errgo.NoteMask(err, "copied, but")
+		}
+	}
+	return copied, nil
+}
+
+// log a copy to the destination, or a deletion from the source, except of
+// the audit log itself, which is migrated before the log is opened
+func auditMigration(e audit.Entry) error {
+	if globalAudit == nil || strings.HasPrefix(e.Name, auditPrefix) {
+		return nil
+	}
+	e.Detail = map[string]string{
+		"by":   "migrate",
+		"from": strings.SplitN(fFrom, "?", 2)[0],
+		"to":   strings.SplitN(fTo, "?", 2)[0],
+	}
+	if _, err := globalAudit.Append(e); err != nil {
+		return errgo.NoteMask(err, "error auditing")
+	}
+	return nil
+}
+
+// whether the object has the hash, by the sha256 in its metadata where the
+// storage keeps it, otherwise by reading it
+func sameHash(s data.Storage, name, hash string) bool {
+	if meta, err := data.ReadMetadata(s, name); err == nil && meta["sha256"] != "" {
+		return meta["sha256"] == hash
+	}
+	buf, err := readObject(s, name)
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+func readObject(s data.Storage, name string) ([]byte, error) {
+	rc, err := s.Open(name)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	return buf, errgo.Mask(err)
+}
+
+func loadSidecarFrom(s data.Storage, name string, rec *index.Recording) error {
+	buf, err := readObject(s, name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(json.Unmarshal(buf, rec))
+}
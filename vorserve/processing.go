@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,42 +20,173 @@ import (
 	"github.com/go-audio/wav"
 	"github.com/juju/errgo"
 	"github.com/orcaman/writerseeker"
+
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/envelope"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// a request from Twillio Studio to store a recording
+type request struct {
+	index.Request
+	log *logging.Logger
+}
+
+// the requests being processed, and other work changing the storage,
+// waited for on shutdown
+var inFlight sync.WaitGroup
+
+// shutdown is cancelled when the server starts shutting down, no work is
+// started after that
+var (
+	shutdown, cancelShutdown = context.WithCancel(context.Background())
+	shutdownMu               sync.Mutex
 )
 
-func processRequest(phone string, urls []string) (responseCode int) {
+// startWork adds to inFlight, unless shutdown has begun, as Add must not be
+// called while Wait is waiting for the count to reach zero. It returns false
+// if the work must not be done, the caller calls inFlight.Done otherwise.
+func startWork() bool {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	if shutdown.Err() != nil {
+		return false
+	}
+	inFlight.Add(1)
+	return true
+}
+
+// refuse new work, which also stops the retention sweeper and the resumer
+func beginShutdown() {
+	shutdownMu.Lock()
+	cancelShutdown()
+	shutdownMu.Unlock()
+}
+
+// process the request, which is kept in the journal of the index until
+// it is done, so that it can be processed again after an unclean shutdown.
+func processRequest(req request) (resp response, responseCode int) {
+	if !startWork() {
+		req.log.Warn("shutting down, request refused")
+		return resp, http.StatusServiceUnavailable
+	}
+	defer inFlight.Done()
+
+	if err := globalIndex.AddRequest(req.Request); err != nil {
+		req.log.Error("error journaling request", "error", err)
+		return resp, http.StatusInternalServerError
+	}
+	resp, responseCode = processJournaled(req)
+	if err := globalIndex.RemoveRequest(req.ID); err != nil {
+		req.log.Error("error removing request from journal", "error", err)
+	}
+	return resp, responseCode
+}
+
+func processJournaled(req request) (resp response, responseCode int) {
 	// abort on error and log, simple solution that should
 	// be good enough for this simple usecase.
 
-	if len(urls) < 1 {
-		log.Println("error: must have at least one url")
-		return http.StatusBadRequest
+	if len(req.URLs) < 1 {
+		req.log.Warn("must have at least one url")
+		return resp, http.StatusBadRequest
 	}
 
-	data, err := gatherWaveBuffers(urls)
+	start := time.Now()
+	data, err := gatherWaveBuffers(req.URLs)
+	var consent []byte
+	if err == nil && req.ConsentURL != "" {
+		consent, err = fetchConsent(req.ConsentURL)
+	}
+	observeStage("download", start)
 	if err != nil {
-		log.Println("error gathering files: ", err)
-		return http.StatusInternalServerError
+		req.log.Error("error gathering files", "error", err)
+		return resp, http.StatusInternalServerError
 	}
 
+	start = time.Now()
+	segments := segmentBoundaries(data)
 	mbuff, err := mergeWaveBuffers(data)
+	observeStage("merge", start)
 	if err != nil {
-		log.Println("error merging files: ", err)
-		return http.StatusInternalServerError
+		req.log.Error("error merging files", "error", err)
+		return resp, http.StatusInternalServerError
 	}
 
+	start = time.Now()
 	r, err := writeWaveFile(mbuff)
+	observeStage("encode", start)
 	if err != nil {
-		log.Println("error writing wave: ", err)
-		return http.StatusInternalServerError
+		req.log.Error("error writing wave", "error", err)
+		return resp, http.StatusInternalServerError
 	}
 
-	err = saveToStorage(r, phone)
+	rec := newRecording(req, mbuff)
+	rec.Segments = segments
+	if globalEncryptionKey != nil {
+		if r, err = envelope.Encrypt(r, globalEncryptionKey); err != nil {
+			req.log.Error("error encrypting recording", "error", err)
+			return resp, http.StatusInternalServerError
+		}
+		rec.Encryption = envelope.Scheme
+	}
+	start = time.Now()
+	cr := &countingReader{r: r}
+	err = saveToStorage(cr, &rec, consent)
+	observeStage("store", start)
 	if err != nil {
-		log.Println("error writing to storage: ", err)
-		return http.StatusInternalServerError
+		req.log.Error("error writing to storage", "error", err)
+		return resp, http.StatusInternalServerError
 	}
+	mStoredBytes.Add(float64(cr.n))
+	mStoredSeconds.Add(rec.Duration)
+	req.log.Info("stored recording", "speaker", rec.Speaker, "session", rec.Session,
+		"duration", rec.Duration, "bytes", cr.n)
+
+	return newResponse(&rec), http.StatusOK
+}
 
-	return http.StatusOK
+// process requests left in the journal by an earlier run, the
+// responses are lost but the recordings are stored.
+func resumeRequests(reqs []index.Request) {
+	for _, r := range reqs {
+		if shutdown.Err() != nil {
+			// left in the journal for the next start
+			return
+		}
+		l := logging.With("request_id", r.ID, "call_sid", r.CallSID)
+		l.Info("resuming interrupted request")
+		if _, code := processRequest(request{r, l}); code != http.StatusOK && code != http.StatusServiceUnavailable {
+			l.Error("could not resume request, it is dropped", "code", code)
+		}
+	}
+}
+
+// describe the merged recording for the index, name and
+// session are set when it is stored.
+func newRecording(req request, mbuff *audio.IntBuffer) index.Recording {
+	var consent *index.Consent
+	if req.Consent != nil || req.ConsentURL != "" {
+		consent = &index.Consent{}
+		if req.Consent != nil {
+			*consent = *req.Consent
+		}
+	}
+	return index.Recording{
+		Speaker:    req.Speaker,
+		Country:    req.Country,
+		CallSID:    req.CallSID,
+		RequestID:  req.ID,
+		Variation:  req.Variation,
+		Duration:   duration(mbuff),
+		SampleRate: mbuff.Format.SampleRate,
+		Channels:   mbuff.Format.NumChannels,
+		BitDepth:   mbuff.SourceBitDepth,
+		Quality:    measureQuality(mbuff),
+		Consent:    consent,
+		Received:   req.Received,
+	}
 }
 
 // download all the sound data in parallel, keeping the order. Fail
@@ -83,27 +221,60 @@ func gatherWaveBuffers(urls []string) ([]*audio.IntBuffer, error) {
 func getWaveBuffer(url string) (*audio.IntBuffer, error) {
 	resp, err := http.Get(url)
 	if err != nil {
+		mDownloadFailures.Inc("request")
+		// the error holds the url, only keep the reason
+		if uerr, ok := err.(*neturl.Error); ok {
+			err = uerr.Err
+		}
 		return nil, errgo.Mask(err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		mDownloadFailures.Inc("status_" + strconv.Itoa(resp.StatusCode))
 		return nil, errgo.New("got non 200 response when downloading file")
 	}
-	defer resp.Body.Close()
 
 	buf := &bytes.Buffer{}
 	_, err = io.Copy(buf, resp.Body)
 	if err != nil {
+		mDownloadFailures.Inc("read")
 		return nil, errgo.Mask(err)
 	}
 
 	dec := wav.NewDecoder(bytes.NewReader(buf.Bytes()))
 	abuf, err := dec.FullPCMBuffer()
 	if err != nil {
+		mDownloadFailures.Inc("decode")
 		return nil, errgo.Mask(err)
 	}
 	return abuf, nil
 }
 
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// the start and end of each downloaded file in the merged recording,
+// in seconds, typically one segment per answered question.
+func segmentBoundaries(data []*audio.IntBuffer) []index.Segment {
+	segs := make([]index.Segment, 0, len(data))
+	start := 0.0
+	for _, d := range data {
+		end := start + duration(d)
+		segs = append(segs, index.Segment{Start: start, End: end})
+		start = end
+	}
+	return segs
+}
+
 // make sure the files have the same sample rate, and format, merge
 // them and write it in memory to a wave file that can later be dumped.
 func mergeWaveBuffers(data []*audio.IntBuffer) (*audio.IntBuffer, error) {
@@ -139,13 +310,81 @@ func writeWaveFile(mbuff *audio.IntBuffer) (io.Reader, error) {
 }
 
 // save the file to storage with a reasonable name that is
-// encrypted as expected.
-func saveToStorage(r io.Reader, phone string) error {
+// encrypted as expected, together with the recorded consent if
+// any. The session and name are reserved in the index first,
+// the recording is only added to it (and the speakers session
+// counted) once the files are stored, which is done outside any
+// transaction of the index.
+func saveToStorage(r io.Reader, rec *index.Recording, consent []byte) error {
 	// theoretically we could have a risk of overwriting data here, multiple
 	// calls from the same number at the same time, but low risk and
 	// since this is not a production system...
-	id := generateID(phone)
-	name := id + "_" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".wav"
-	err := globalStorage.Store(name, r)
-	return errgo.Mask(err)
+	// the content is hashed before it is stored, so that the hash can be
+	// given as object metadata
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	sum := sha256.Sum256(buf)
+	rec.SHA256 = hex.EncodeToString(sum[:])
+	rec.Stored = time.Now().UTC()
+	err = globalIndex.Reserve(rec, func(rec *index.Recording) error {
+		// the name may include the session, set by Reserve
+		var err error
+		rec.Name, err = recordingName(rec)
+		return errgo.Mask(err)
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	rec.Code = referenceCode(rec.Name)
+	if err := storeRecording(rec, buf, consent); err != nil {
+		if rerr := globalIndex.Release(rec); rerr != nil {
+			logging.Error("error releasing session", "error", rerr, "name", rec.Name)
+		}
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(globalIndex.Commit(rec))
+}
+
+func storeRecording(rec *index.Recording, buf, consent []byte) error {
+	if err := storeConsent(rec, consent); err != nil {
+		return errgo.Mask(err)
+	}
+	meta := objectMetadata(rec)
+	meta["sha256"] = rec.SHA256
+	if err := globalStorage.Store(rec.Name, bytes.NewReader(buf), meta); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(storeSidecar(rec))
+}
+
+// metadata stored with both the recording and its sidecar
+func objectMetadata(rec *index.Recording) data.Metadata {
+	meta := data.Metadata{
+		"speaker-id":     rec.Speaker,
+		"duration":       strconv.FormatFloat(rec.Duration, 'f', 3, 64),
+		"schema-version": strconv.Itoa(index.SchemaVersion),
+	}
+	if rec.Encryption != "" {
+		meta["encryption"] = rec.Encryption
+	}
+	return meta
+}
+
+// the sidecar holds the index metadata next to the recording, allowing
+// the index to be rebuilt from the storage alone.
+func storeSidecar(rec *index.Recording) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	meta := objectMetadata(rec)
+	sum := sha256.Sum256(buf)
+	meta["sha256"] = hex.EncodeToString(sum[:])
+	return errgo.Mask(globalStorage.Store(sidecarName(rec.Name), bytes.NewReader(buf), meta))
+}
+
+func sidecarName(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + ".json"
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+
+	"github.com/go-audio/audio"
+
+	"github.com/newtechlab/vor/vorserve/index"
+)
+
+const (
+	// windows quieter than this are counted as silence
+	silenceThreshold = -45.0
+	silenceWindow    = 0.02
+)
+
+// compute simple quality metrics of the recording, the levels are
+// relative to full scale of the source bit depth.
+func measureQuality(buf *audio.IntBuffer) index.Quality {
+	q := index.Quality{}
+	if len(buf.Data) == 0 || buf.SourceBitDepth < 8 {
+		return q
+	}
+	full := math.Pow(2, float64(buf.SourceBitDepth-1))
+	offset := 0.0
+	if buf.SourceBitDepth == 8 {
+		// 8 bit wave files are unsigned
+		offset = full
+	}
+
+	window := int(silenceWindow*float64(buf.Format.SampleRate)) * buf.Format.NumChannels
+	if window < 1 {
+		window = 1
+	}
+	peak, sum, clipped := 0.0, 0.0, 0
+	wsum, wn, windows, silent := 0.0, 0, 0, 0
+	for _, v := range buf.Data {
+		s := math.Abs(float64(v)-offset) / full
+		if s > peak {
+			peak = s
+		}
+		if s >= 1-1/full {
+			clipped++
+		}
+		sum += s * s
+		wsum += s * s
+		wn++
+		if wn == window {
+			if decibel(math.Sqrt(wsum/float64(wn))) < silenceThreshold {
+				silent++
+			}
+			windows++
+			wsum, wn = 0, 0
+		}
+	}
+
+	q.Peak = decibel(peak)
+	q.RMS = decibel(math.Sqrt(sum / float64(len(buf.Data))))
+	q.Clipping = float64(clipped) / float64(len(buf.Data))
+	if windows > 0 {
+		q.Silence = float64(silent) / float64(windows)
+	}
+	return q
+}
+
+// convert a linear level to dBFS, floored to keep it JSON friendly
+func decibel(v float64) float64 {
+	if v < 1e-6 {
+		return -120
+	}
+	return math.Round(20*math.Log10(v)*100) / 100
+}
+
+// duration of the buffer in seconds
+func duration(buf *audio.IntBuffer) float64 {
+	if buf.Format.SampleRate == 0 || buf.Format.NumChannels == 0 {
+		return 0
+	}
+	return float64(len(buf.Data)) / float64(buf.Format.NumChannels*buf.Format.SampleRate)
+}
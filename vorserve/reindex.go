@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-audio/wav"
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// problems found while reindexing, reported but never fatal
+type reindexReport struct {
+	orphans      []string
+	inconsistent []string
+	stale        []string
+}
+
+// rebuild the index from the recordings and sidecars in the storage. Running
+// it again on the same storage gives the same index, existing index entries
+// are only used to fill in recordings lacking a sidecar.
+func runReindex() {
+	setupStorage()
+	setupEncryption()
+	setupIndex()
+	defer globalIndex.Close()
+
+	prev := map[string]index.Recording{}
+	old, err := globalIndex.All()
+	if err != nil {
+		logging.Fatal("error reading index", "error", err)
+	}
+	for _, r := range old {
+		prev[r.Name] = r
+	}
+
+	recs, report, err := scanStorage(prev)
+	if err != nil {
+		logging.Fatal("error listing storage", "error", err)
+	}
+	for name := range prev {
+		report.stale = append(report.stale, name)
+	}
+
+	report.print(len(recs))
+	if fDryRun {
+		fmt.Println("dry run, index not updated")
+		return
+	}
+	if err := globalIndex.Rebuild(recs); err != nil {
+		logging.Fatal("error rebuilding index", "error", err)
+	}
+}
+
+// find all recordings in the storage and their metadata, ordered by the
+// time they were stored. Entries of prev matching a recording are used if
+// it has no sidecar, and are removed from prev.
+func scanStorage(prev map[string]index.Recording) ([]index.Recording, reindexReport, error) {
+	report := reindexReport{}
+	objs, err := globalStorage.List("")
+	if err != nil {
+		return nil, report, errgo.Mask(err)
+	}
+	wavs := []data.Object{}
+	sidecars := map[string]bool{}
+	consents := map[string]bool{}
+	for _, o := range objs {
+		if strings.HasPrefix(o.Name, auditPrefix) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(o.Name, consentSuffix):
+			consents[o.Name] = true
+		case path.Ext(o.Name) == ".wav":
+			wavs = append(wavs, o)
+		case path.Ext(o.Name) == ".json":
+			sidecars[o.Name] = false
+		default:
+			report.orphans = append(report.orphans, o.Name+": unknown object")
+		}
+	}
+
+	recs := []index.Recording{}
+	for _, o := range wavs {
+		sc := sidecarName(o.Name)
+		_, hasSidecar := sidecars[sc]
+		if hasSidecar {
+			sidecars[sc] = true
+		}
+		p, hasPrev := prev[o.Name]
+		delete(prev, o.Name)
+		rec, ok := reindexRecording(o, hasSidecar, p, hasPrev, &report)
+		if ok {
+			recs = append(recs, rec)
+			if rec.Consent != nil && rec.Consent.Recording != "" {
+				if !consents[rec.Consent.Recording] {
+					report.inconsistent = append(report.inconsistent, o.Name+": recorded consent "+rec.Consent.Recording+" is missing")
+				}
+				delete(consents, rec.Consent.Recording)
+			}
+		}
+	}
+	for c := range consents {
+		report.orphans = append(report.orphans, c+": recorded consent without recording")
+	}
+	for sc, used := range sidecars {
+		if !used {
+			report.orphans = append(report.orphans, sc+": sidecar without recording")
+		}
+	}
+	numberSessions(recs)
+	return recs, report, nil
+}
+
+// gather the metadata of a recording, preferring its sidecar, then an existing
+// index entry and finally what can be parsed from the name. The wave header is
+// probed if the format is still unknown.
+func reindexRecording(o data.Object, hasSidecar bool, prev index.Recording, hasPrev bool, report *reindexReport) (rec index.Recording, ok bool) {
+	problem := func(msg string) {
+		report.inconsistent = append(report.inconsistent, o.Name+": "+msg)
+	}
+
+	found := false
+	if hasSidecar {
+		if err := loadSidecar(sidecarName(o.Name), &rec); err != nil {
+			problem("bad sidecar: " + err.Error())
+		} else {
+			found = true
+			if rec.Name != o.Name {
+				problem("sidecar is for " + rec.Name)
+				rec.Name = o.Name
+			}
+		}
+	}
+	if !found && hasPrev {
+		rec, found = prev, true
+	}
+	if !found {
+		var err error
+		rec, err = parseRecordingName(o.Name)
+		if err != nil {
+			report.orphans = append(report.orphans, o.Name+": "+err.Error())
+			return rec, false
+		}
+	}
+
+	if rec.Code == "" {
+		rec.Code = referenceCode(rec.Name)
+	}
+	if rec.SampleRate == 0 || rec.Duration == 0 {
+		if err := probeWave(&rec); err != nil {
+			problem("bad wave file: " + err.Error())
+		}
+	}
+	return rec, true
+}
+
+func loadSidecar(name string, rec *index.Recording) error {
+	r, err := globalStorage.Open(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer r.Close()
+	return errgo.Mask(json.NewDecoder(r).Decode(rec))
+}
+
+// names written by vorserve without sidecars are <id>_<unix nanos>.wav,
+// note that the id itself may contain _
+func parseRecordingName(name string) (index.Recording, error) {
+	rec := index.Recording{Name: name, Variation: -1}
+	base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+	i := strings.LastIndex(base, "_")
+	if i < 1 {
+		return rec, errgo.New("unrecognized name and no sidecar")
+	}
+	nanos, err := strconv.ParseInt(base[i+1:], 10, 64)
+	if err != nil {
+		return rec, errgo.New("unrecognized name and no sidecar")
+	}
+	rec.Speaker = base[:i]
+	rec.Stored = time.Unix(0, nanos).UTC()
+	return rec, nil
+}
+
+// read the recording from storage to get its format, duration and quality
+func probeWave(rec *index.Recording) error {
+	r, err := openAudio(rec.Name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	dec := wav.NewDecoder(bytes.NewReader(buf))
+	abuf, err := dec.FullPCMBuffer()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	rec.SampleRate = abuf.Format.SampleRate
+	rec.Channels = abuf.Format.NumChannels
+	rec.BitDepth = abuf.SourceBitDepth
+	rec.Duration = duration(abuf)
+	rec.Quality = measureQuality(abuf)
+	return nil
+}
+
+// recordings without a known session are numbered in the order they
+// were stored, after the highest known session of the speaker.
+func numberSessions(recs []index.Recording) {
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Stored.Before(recs[j].Stored)
+	})
+	last := map[string]int{}
+	for _, r := range recs {
+		if r.Session > last[r.Speaker] {
+			last[r.Speaker] = r.Session
+		}
+	}
+	for i := range recs {
+		if recs[i].Session == 0 {
+			last[recs[i].Speaker]++
+			recs[i].Session = last[recs[i].Speaker]
+		}
+	}
+}
+
+func (r reindexReport) print(indexed int) {
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"orphans", r.orphans},
+		{"inconsistencies", r.inconsistent},
+		{"removed from index, not in storage", r.stale},
+	}
+	for _, s := range sections {
+		if len(s.lines) == 0 {
+			continue
+		}
+		sort.Strings(s.lines)
+		fmt.Printf("%v (%v):\n", s.title, len(s.lines))
+		for _, l := range s.lines {
+			fmt.Println("  " + l)
+		}
+	}
+	fmt.Printf("%v recordings indexed, %v orphans, %v inconsistencies, %v removed\n",
+		indexed, len(r.orphans), len(r.inconsistent), len(r.stale))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// copy objects missing in some backends of a replicated storage from the
+// others, e.g. after a backend was unreachable or misconfigured. Each copy
+// is logged to the audit log.
+func runRepair() {
+	setupStorage()
+	s := globalStorage
+	setupAudit()
+
+	report, err := data.Repair(s, fDryRun, repairMetadata, auditRepair)
+	if err != nil {
+		logging.Fatal("error repairing storage", "error", err)
+	}
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"copied", report.Copied},
+		{"conflicts, not changed", report.Conflicts},
+		{"failed", report.Failed},
+	}
+	for _, s := range sections {
+		if len(s.lines) == 0 {
+			continue
+		}
+		sort.Strings(s.lines)
+		fmt.Printf("%v (%v):\n", s.title, len(s.lines))
+		for _, l := range s.lines {
+			fmt.Println("  " + l)
+		}
+	}
+	fmt.Printf("%v copied, %v conflicts, %v failed\n", len(report.Copied), len(report.Conflicts), len(report.Failed))
+	if fDryRun {
+		fmt.Println("dry run, nothing copied")
+	}
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// log a copy made by repair, except of the audit log itself
+func auditRepair(name, backend string, size int64, hash string) error {
+	if strings.HasPrefix(name, auditPrefix) {
+		return nil
+	}
+	_, err := globalAudit.Append(audit.Entry{
+		Op:     audit.OpStore,
+		Name:   name,
+		Size:   size,
+		SHA256: hash,
+		Detail: map[string]string{"by": "repair", "to": backend},
+	})
+	return errgo.Mask(err)
+}
+
+// the metadata of objects copied by repair or migrate from storages that do
+// not keep it, from the sidecar of the recording as when stored
+func repairMetadata(from data.Storage, name string) data.Metadata {
+	if strings.HasPrefix(name, auditPrefix) {
+		return nil
+	}
+	sidecar := sidecarName(name)
+	switch {
+	case path.Ext(name) == ".json":
+		sidecar = name
+	case strings.HasSuffix(name, consentSuffix):
+		sidecar = sidecarName(consentOf(name))
+	}
+	rec := index.Recording{}
+	if err := loadSidecarFrom(from, sidecar, &rec); err != nil {
+		return nil
+	}
+	if strings.HasSuffix(name, consentSuffix) {
+		return consentMetadata(&rec)
+	}
+	return objectMetadata(&rec)
+}
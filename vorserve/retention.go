@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/audit"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// objects under this prefix are records of what vorserve did to the
+// storage, they are not recordings
+const auditPrefix = "audit/"
+
+// a retention period for the recordings with names starting with prefix
+type retentionRule struct {
+	prefix              string
+	years, months, days int
+	period              string
+}
+
+// how long recordings are kept, the rule with the longest matching prefix
+// applies, the rule without a prefix to all other recordings
+type retentionPolicy []retentionRule
+
+// parse e.g. "24m,pilot/=6m,test/=30d", units are d(ays), w(eeks), m(onths)
+// and y(ears)
+func parseRetention(s string) (retentionPolicy, error) {
+	p := retentionPolicy{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		r := retentionRule{}
+		if i := strings.LastIndex(part, "="); i >= 0 {
+			r.prefix, part = part[:i], part[i+1:]
+			if r.prefix == "" {
+				return nil, errgo.New("empty retention prefix")
+			}
+		}
+		if len(part) < 2 {
+			return nil, errgo.New("bad retention period: " + part)
+		}
+		n, err := strconv.Atoi(part[:len(part)-1])
+		if err != nil || n <= 0 {
+			return nil, errgo.New("bad retention period: " + part)
+		}
+		switch part[len(part)-1] {
+		case 'd':
+			r.days = n
+		case 'w':
+			r.days = 7 * n
+		case 'm':
+			r.months = n
+		case 'y':
+			r.years = n
+		default:
+			return nil, errgo.New("retention periods must end with d, w, m or y: " + part)
+		}
+		r.period = part
+		for _, o := range p {
+			if o.prefix == r.prefix {
+				return nil, errgo.New("more than one retention period for prefix " + strconv.Quote(r.prefix))
+			}
+		}
+		p = append(p, r)
+	}
+	// longest prefix first
+	sort.Slice(p, func(i, j int) bool {
+		return len(p[i].prefix) > len(p[j].prefix)
+	})
+	return p, nil
+}
+
+// the rule of a recording, false if it is kept forever
+func (p retentionPolicy) rule(name string) (retentionRule, bool) {
+	for _, r := range p {
+		if strings.HasPrefix(name, r.prefix) {
+			return r, true
+		}
+	}
+	return retentionRule{}, false
+}
+
+func (r retentionRule) String() string {
+	if r.prefix == "" {
+		return r.period
+	}
+	return r.prefix + "=" + r.period
+}
+
+func (r retentionRule) expires(stored time.Time) time.Time {
+	return stored.AddDate(r.years, r.months, r.days)
+}
+
+// legal holds exempt recordings from retention, the file has a speaker id
+// or name prefix per line, # starts a comment. It is read on every sweep.
+func loadLegalHolds() ([]string, error) {
+	if fLegalHolds == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fLegalHolds)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer f.Close()
+	holds := []string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		l := strings.TrimSpace(strings.SplitN(sc.Text(), "#", 2)[0])
+		if l != "" {
+			holds = append(holds, l)
+		}
+	}
+	return holds, errgo.Mask(sc.Err())
+}
+
+func held(rec index.Recording, holds []string) bool {
+	for _, h := range holds {
+		if rec.Speaker == h || strings.HasPrefix(rec.Name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// a recording deleted, or to be deleted, by retention
+type expiredRecording struct {
+	Name    string
+	Speaker string
+	Stored  time.Time
+	Expired time.Time
+	Rule    string
+	Held    bool
+	Error   string
+}
+
+// delete the recordings of recs that have expired, with their sidecars,
+// from the storage and the index, unless they are held. It returns what
+// was, or with dryRun would be, deleted and held.
+func sweepRetention(recs []index.Recording, p retentionPolicy, dryRun bool) (deleted, failed, kept []expiredRecording, err error) {
+	holds, err := loadLegalHolds()
+	if err != nil {
+		return nil, nil, nil, errgo.NoteMask(err, "error reading legal holds")
+	}
+	now := time.Now().UTC()
+	for _, rec := range recs {
+		r, ok := p.rule(rec.Name)
+		if !ok || rec.Stored.IsZero() || r.expires(rec.Stored).After(now) {
+			continue
+		}
+		e := expiredRecording{
+			Name:    rec.Name,
+			Speaker: rec.Speaker,
+			Stored:  rec.Stored,
+			Expired: r.expires(rec.Stored),
+			Rule:    r.String(),
+		}
+		if held(rec, holds) {
+			e.Held = true
+			kept = append(kept, e)
+			continue
+		}
+		if !dryRun {
+			if err := deleteExpired(rec, e); err != nil {
+				e.Error = err.Error()
+				failed = append(failed, e)
+				continue
+			}
+		}
+		deleted = append(deleted, e)
+	}
+	return deleted, failed, kept, nil
+}
+
+// log why the recording is deleted before deleting it
+func deleteExpired(rec index.Recording, e expiredRecording) error {
+	_, err := globalAudit.Append(audit.Entry{
+		Op:   audit.OpRetention,
+		Name: e.Name,
+		Detail: map[string]string{
+			"speaker": e.Speaker,
+			"stored":  e.Stored.Format(time.RFC3339Nano),
+			"rule":    e.Rule,
+		},
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(deleteRecording(rec))
+}
+
+// delete the recording and its recorded consent, then its sidecar and
+// last the index entry, so an interrupted delete is finished by the next
+// sweep
+func deleteRecording(rec index.Recording) error {
+	if err := globalStorage.Delete(rec.Name); err != nil {
+		return errgo.Mask(err)
+	}
+	if rec.Consent != nil && rec.Consent.Recording != "" {
+		if err := globalStorage.Delete(rec.Consent.Recording); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := globalStorage.Delete(sidecarName(rec.Name)); err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(globalIndex.Remove(rec.Name))
+}
+
+// the recordings in the storage, including those the index lost, with
+// their index entries where they have no sidecar
+func storedRecordings() ([]index.Recording, error) {
+	prev := map[string]index.Recording{}
+	old, err := globalIndex.All()
+	if err != nil {
+		return nil, errgo.NoteMask(err, "error reading index")
+	}
+	for _, r := range old {
+		prev[r.Name] = r
+	}
+	recs, _, err := scanStorage(prev)
+	return recs, errgo.Mask(err)
+}
+
+// sweep the index every -retention-interval while the server runs,
+// recordings the index lost are only found by the retention command, which
+// lists the storage
+func runRetentionSweeper() {
+	p, err := parseRetention(fRetention)
+	if err != nil {
+		logging.Fatal("bad retention", "error", err)
+	}
+	if len(p) == 0 || fRetentionInterval <= 0 {
+		return
+	}
+	for {
+		if !startWork() {
+			return
+		}
+		recs, err := globalIndex.All()
+		if err != nil {
+			logging.Error("error reading index for retention", "error", err)
+		} else {
+			deleted, failed, kept, err := sweepRetention(recs, p, false)
+			if err != nil {
+				logging.Error("error applying retention", "error", err)
+			}
+			for _, e := range failed {
+				logging.Error("error deleting expired recording", "name", e.Name, "error", e.Error)
+			}
+			logging.Info("applied retention", "deleted", len(deleted), "failed", len(failed), "held", len(kept))
+		}
+		inFlight.Done()
+		select {
+		case <-shutdown.Done():
+			return
+		case <-time.After(fRetentionInterval):
+		}
+	}
+}
+
+// apply retention to the recordings in the storage, including those the
+// index lost, for running from cron when the server is stopped, or with -dry-run to see what would be deleted.
+// It needs the index, so it can not run next to the server, which applies
+// retention itself.
+func runRetention() {
+	p, err := parseRetention(fRetention)
+	if err != nil {
+		showError(err.Error())
+	}
+	if len(p) == 0 {
+		showError("you must provide a value for the retention flag")
+	}
+	setupStorage()
+	setupEncryption()
+	if globalIndex, err = index.Open(fDB); errgo.Cause(err) == index.ErrLocked {
+		showError("the index is in use, the retention command only runs while the server is stopped, a running server applies -retention itself every -retention-interval")
+	} else if err != nil {
+		logging.Fatal("error opening index", "error", err)
+	}
+	defer globalIndex.Close()
+	setupAudit()
+
+	recs, err := storedRecordings()
+	if err != nil {
+		logging.Fatal("error listing recordings", "error", err)
+	}
+	deleted, failed, kept, err := sweepRetention(recs, p, fDryRun)
+
+	sections := []struct {
+		title string
+		list  []expiredRecording
+	}{
+		{"deleted", deleted},
+		{"held", kept},
+		{"failed", failed},
+	}
+	if fDryRun {
+		sections[0].title = "would delete"
+	}
+	for _, s := range sections {
+		if len(s.list) == 0 {
+			continue
+		}
+		fmt.Printf("%v (%v):\n", s.title, len(s.list))
+		for _, e := range s.list {
+			fmt.Printf("  %v stored %v, expired %v (%v) %v\n", e.Name, e.Stored.Format("2006-01-02"),
+				e.Expired.Format("2006-01-02"), e.Rule, e.Error)
+		}
+	}
+	fmt.Printf("%v deleted, %v held, %v failed\n", len(deleted), len(kept), len(failed))
+	if fDryRun {
+		fmt.Println("dry run, nothing deleted")
+	}
+	if err != nil {
+		logging.Fatal("error applying retention", "error", err)
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
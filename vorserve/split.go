@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/index"
+)
+
+var splitNames = []string{"train", "validation", "test"}
+
+// how speakers are divided into splits, parsed from the flags
+type splitConfig struct {
+	ratios   []float64
+	seed     string
+	session  bool
+	country  bool
+	trials   int
+	disabled bool
+}
+
+func parseSplitConfig() (splitConfig, error) {
+	c := splitConfig{seed: fSplitSeed, trials: fTrials}
+	if fSplit == "" {
+		c.disabled = true
+		return c, nil
+	}
+	parts := strings.Split(fSplit, ",")
+	if len(parts) != len(splitNames) {
+		return c, errgo.New("split must have a ratio for each of " + strings.Join(splitNames, ","))
+	}
+	sum := 0.0
+	for _, p := range parts {
+		r, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || r < 0 {
+			return c, errgo.New("bad split ratio: " + p)
+		}
+		c.ratios = append(c.ratios, r)
+		sum += r
+	}
+	if sum == 0 {
+		return c, errgo.New("split ratios can not all be zero")
+	}
+	for i := range c.ratios {
+		c.ratios[i] /= sum
+	}
+	for _, s := range strings.Split(fStratify, ",") {
+		switch strings.TrimSpace(s) {
+		case "":
+		case "session":
+			c.session = true
+		case "country":
+			c.country = true
+		default:
+			return c, errgo.New("can only stratify by session and country, not: " + s)
+		}
+	}
+	return c, nil
+}
+
+// assign each speaker to a split. Unstratified the split only depends on
+// the seed and the speaker id, so speakers keep their split as more data
+// is collected. Stratified, the speakers of each stratum are ordered by
+// the same hash and divided according to the ratios, which balances the
+// splits but may move speakers when new ones are added.
+func assignSplits(recs []index.Recording, c splitConfig) map[string]string {
+	sessions := map[string]int{}
+	countries := map[string]string{}
+	for _, r := range recs {
+		sessions[r.Speaker]++
+		if r.Country != "" {
+			countries[r.Speaker] = r.Country
+		}
+	}
+
+	splits := map[string]string{}
+	if !c.session && !c.country {
+		for speaker := range sessions {
+			splits[speaker] = c.pick(speakerHash(c.seed, speaker))
+		}
+		return splits
+	}
+
+	strata := map[string][]string{}
+	for speaker, n := range sessions {
+		key := ""
+		if c.session {
+			if n > fSessions {
+				n = fSessions
+			}
+			key += strconv.Itoa(n)
+		}
+		if c.country {
+			key += "/" + countries[speaker]
+		}
+		strata[key] = append(strata[key], speaker)
+	}
+	for _, speakers := range strata {
+		sort.Slice(speakers, func(i, j int) bool {
+			return speakerHash(c.seed, speakers[i]) < speakerHash(c.seed, speakers[j])
+		})
+		for i, speaker := range speakers {
+			splits[speaker] = c.pick((float64(i) + 0.5) / float64(len(speakers)))
+		}
+	}
+	return splits
+}
+
+// the split a value in [0, 1) falls in
+func (c splitConfig) pick(v float64) string {
+	acc := 0.0
+	for i, r := range c.ratios {
+		acc += r
+		if v < acc {
+			return splitNames[i]
+		}
+	}
+	return splitNames[len(splitNames)-1]
+}
+
+// a uniform value in [0, 1) derived from the seed and speaker
+func speakerHash(seed, speaker string) float64 {
+	sum := sha256.Sum256([]byte(seed + "/" + speaker))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// write a dataset per split, with trial lists for all but train
+func writeSplits(dir string, utts []utterance, c splitConfig) error {
+	for _, name := range splitNames {
+		subset := []utterance{}
+		for _, u := range utts {
+			if u.Split == name {
+				subset = append(subset, u)
+			}
+		}
+		sdir := filepath.Join(dir, name)
+		if err := writeDataset(sdir, subset); err != nil {
+			return errgo.Mask(err)
+		}
+		if name == "train" {
+			continue
+		}
+		if err := writeTrials(filepath.Join(sdir, "trials"), subset, c); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// write up to c.trials target and non target pairs, as "<utt> <utt> target".
+// Target pairs are from different recordings of the same speaker.
+func writeTrials(name string, utts []utterance, c splitConfig) error {
+	seed := int64(speakerHash(c.seed, "trials") * (1 << 53))
+	rng := rand.New(rand.NewSource(seed))
+
+	// utterance ids start with the speaker, so once sorted the
+	// utterances of a speaker are next to each other
+	sort.Slice(utts, func(i, j int) bool {
+		return utts[i].ID < utts[j].ID
+	})
+	targets := []string{}
+	for i := range utts {
+		for j := i + 1; j < len(utts) && utts[i].Speaker == utts[j].Speaker; j++ {
+			if utts[i].Recording != utts[j].Recording {
+				targets = append(targets, utts[i].ID+" "+utts[j].ID+" target")
+			}
+		}
+	}
+	rng.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	if len(targets) > c.trials {
+		targets = targets[:c.trials]
+	}
+
+	seen := map[string]bool{}
+	for n := 0; n < 10*c.trials && len(seen) < c.trials && len(utts) > 1; n++ {
+		a, b := utts[rng.Intn(len(utts))], utts[rng.Intn(len(utts))]
+		if a.Speaker == b.Speaker {
+			continue
+		}
+		if a.ID > b.ID {
+			a, b = b, a
+		}
+		seen[a.ID+" "+b.ID+" nontarget"] = true
+	}
+
+	lines := targets
+	for l := range seen {
+		lines = append(lines, l)
+	}
+	sort.Strings(lines)
+	fmt.Printf("%v: %v target and %v non target trials\n", name, len(targets), len(seen))
+	return errgo.Mask(writeLines(name, lines))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errgo"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// setupTLS returns the TLS config of the public listener and the handler of
+// the plain HTTP listener, which redirects to HTTPS and answers the ACME
+// HTTP-01 challenges. The config is nil when TLS is terminated by a proxy.
+func setupTLS() (*tls.Config, http.Handler) {
+	c, h, err := newTLSConfig()
+	if err != nil {
+		logging.Fatal("error setting up tls", "error", err)
+	}
+	return c, h
+}
+
+func newTLSConfig() (*tls.Config, http.Handler, error) {
+	static := fTLSCert != "" || fTLSKey != ""
+	switch {
+	case static && fACMEDomains != "":
+		return nil, nil, errgo.New("use either a certificate and key or acme, not both")
+	case static && (fTLSCert == "" || fTLSKey == ""):
+		return nil, nil, errgo.New("both a certificate and a key must be given")
+	case static:
+		cert, err := tls.LoadX509KeyPair(fTLSCert, fTLSKey)
+		if err != nil {
+			return nil, nil, errgo.NoteMask(err, "could not load certificate")
+		}
+		c := modernTLS()
+		c.Certificates = []tls.Certificate{cert}
+		return c, http.HandlerFunc(redirectHandler), nil
+	case fACMEDomains != "":
+		// Let's Encrypt only connects to port 80 for HTTP-01 challenges
+		if _, port, err := net.SplitHostPort(fHTTP); err != nil || port != "80" {
+			return nil, nil, errgo.New("with acme -http must be on port 80 to answer the challenges, e.g. -http :80")
+		}
+		domains := strings.Split(fACMEDomains, ",")
+		for i := range domains {
+			domains[i] = strings.TrimSpace(domains[i])
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(fACMECache),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      fACMEEmail,
+			// the RFC 8555 (ACMEv2) api, the only one Let's Encrypt serves
+			Client: &acme.Client{DirectoryURL: acme.LetsEncryptURL},
+		}
+		c := modernTLS()
+		c.GetCertificate = m.GetCertificate
+		return c, m.HTTPHandler(http.HandlerFunc(redirectHandler)), nil
+	}
+	return nil, nil, nil
+}
+
+// TLS 1.2 or later, with only forward secret AEAD cipher suites
+func modernTLS() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
+
+// redirect plain HTTP requests to the same url on the HTTPS listener, 308
+// keeps the method and body, but the request has then already been sent in
+// the clear, so the webhook must be configured with the https url.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(fHTTPS); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// tell browsers to only use HTTPS for the domain from now on
+func strictTransport(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juju/errgo"
+
+	"github.com/newtechlab/vor/vorserve/data"
+	"github.com/newtechlab/vor/vorserve/envelope"
+	"github.com/newtechlab/vor/vorserve/index"
+	"github.com/newtechlab/vor/vorserve/logging"
+)
+
+// problems found by verify
+type verifyReport struct {
+	missing      []string
+	corrupt      []string
+	orphans      []string
+	inconsistent []string
+	// recordings without a known hash, or encrypted without a key to
+	// check the wave header
+	unchecked []string
+}
+
+// re-read every recording in the storage and check it against the hash
+// recorded in its sidecar, its metadata and the index, and that it is a
+// wave file of the recorded format. Recordings in the index but not in the
+// storage are missing. The index is only read, while the server has it open
+// only the storage is checked.
+func runVerify() {
+	setupStorage()
+	setupEncryption()
+
+	indexed := map[string]index.Recording{}
+	prev := map[string]index.Recording{}
+	for _, r := range indexedRecordings() {
+		indexed[r.Name] = r
+		prev[r.Name] = r
+	}
+	recs, scan, err := scanStorage(prev)
+	if err != nil {
+		logging.Fatal("error listing storage", "error", err)
+	}
+
+	report := verifyReport{orphans: scan.orphans, inconsistent: scan.inconsistent}
+	for name := range prev {
+		if strings.HasPrefix(name, fPrefix) {
+			report.missing = append(report.missing, name)
+		}
+	}
+	n := 0
+	for _, rec := range recs {
+		if !strings.HasPrefix(rec.Name, fPrefix) {
+			continue
+		}
+		n++
+		verifyRecording(rec, indexed[rec.Name], &report)
+		verifyConsent(rec, &report)
+	}
+
+	report.print(n)
+	if len(report.missing)+len(report.corrupt) > 0 {
+		os.Exit(1)
+	}
+}
+
+// the recordings in the index, none if it does not exist or is in use
+func indexedRecordings() []index.Recording {
+	if _, err := os.Stat(fDB); os.IsNotExist(err) {
+		logging.Warn("no index, only checking the storage", "db", fDB)
+		return nil
+	}
+	idx, err := index.OpenReadOnly(fDB)
+	if errgo.Cause(err) == index.ErrLocked {
+		logging.Warn("the index is in use, only checking the storage", "db", fDB)
+		return nil
+	}
+	if err != nil {
+		logging.Fatal("error opening index", "error", err)
+	}
+	defer idx.Close()
+	recs, err := idx.All()
+	if err != nil {
+		logging.Fatal("error reading index", "error", err)
+	}
+	return recs
+}
+
+// a mismatch of the content with the sha256 kept in the metadata of the
+// object, e.g. when it was overwritten without the metadata
+func checkStoredHash(name, hash string, report *verifyReport) bool {
+	meta, err := data.ReadMetadata(globalStorage, name)
+	if err != nil {
+		report.unchecked = append(report.unchecked, name+": error reading metadata: "+err.Error())
+		return true
+	}
+	if h := meta["sha256"]; h != "" && h != hash {
+		report.corrupt = append(report.corrupt, name+": hash differs from the sha256 metadata")
+		return false
+	}
+	return true
+}
+
+func verifyRecording(rec, indexed index.Recording, report *verifyReport) {
+	rc, err := globalStorage.Open(rec.Name)
+	if err != nil {
+		report.missing = append(report.missing, rec.Name+": "+err.Error())
+		return
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		report.missing = append(report.missing, rec.Name+": "+err.Error())
+		return
+	}
+
+	sum := sha256.Sum256(buf)
+	hash := hex.EncodeToString(sum[:])
+	if !checkStoredHash(rec.Name, hash, report) {
+		return
+	}
+	switch {
+	case rec.SHA256 == "" && indexed.SHA256 == "":
+		report.unchecked = append(report.unchecked, rec.Name+": no hash recorded")
+	case rec.SHA256 != "" && rec.SHA256 != hash:
+		report.corrupt = append(report.corrupt, rec.Name+": hash differs from the sidecar")
+		return
+	case indexed.SHA256 != "" && indexed.SHA256 != hash:
+		report.corrupt = append(report.corrupt, rec.Name+": hash differs from the index")
+		return
+	}
+
+	r, encrypted, err := envelope.Detect(bytes.NewReader(buf))
+	if err != nil {
+		report.corrupt = append(report.corrupt, rec.Name+": "+err.Error())
+		return
+	}
+	if encrypted {
+		if globalDecryptionKey == nil {
+			report.unchecked = append(report.unchecked, rec.Name+": encrypted, wave header not checked without -decryption-key")
+			return
+		}
+		if r, err = envelope.Decrypt(r, globalDecryptionKey); err == nil {
+			buf, err = ioutil.ReadAll(r)
+		}
+		if err != nil {
+			report.corrupt = append(report.corrupt, rec.Name+": "+err.Error())
+			return
+		}
+	}
+	if err := checkWave(buf, rec); err != nil {
+		report.corrupt = append(report.corrupt, rec.Name+": "+err.Error())
+	}
+}
+
+// the recorded consent is only checked against its hash
+func verifyConsent(rec index.Recording, report *verifyReport) {
+	if rec.Consent == nil || rec.Consent.Recording == "" {
+		return
+	}
+	name := rec.Consent.Recording
+	rc, err := globalStorage.Open(name)
+	if err != nil {
+		report.missing = append(report.missing, name+": "+err.Error())
+		return
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		report.missing = append(report.missing, name+": "+err.Error())
+		return
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if !checkStoredHash(name, hash, report) {
+		return
+	}
+	if hash != rec.Consent.RecordingSHA256 {
+		report.corrupt = append(report.corrupt, name+": hash differs from the sidecar")
+	}
+}
+
+// check that the header of the wave file agrees with its length and the
+// recorded format
+func checkWave(buf []byte, rec index.Recording) error {
+	if len(buf) < 12 || string(buf[:4]) != "RIFF" || string(buf[8:12]) != "WAVE" {
+		return errgo.New("not a wave file")
+	}
+	if size := binary.LittleEndian.Uint32(buf[4:8]); int64(size) != int64(len(buf))-8 {
+		return errgo.Newf("RIFF size is %v, file has %v bytes", size, len(buf)-8)
+	}
+	var rate, channels, bits int
+	dataSize := -1
+	for p := 12; p+8 <= len(buf); {
+		id, size := string(buf[p:p+4]), int(binary.LittleEndian.Uint32(buf[p+4:p+8]))
+		p += 8
+		if size < 0 || p+size > len(buf) {
+			return errgo.Newf("%q chunk is truncated", id)
+		}
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return errgo.New("bad fmt chunk")
+			}
+			channels = int(binary.LittleEndian.Uint16(buf[p+2:]))
+			rate = int(binary.LittleEndian.Uint32(buf[p+4:]))
+			bits = int(binary.LittleEndian.Uint16(buf[p+14:]))
+		case "data":
+			dataSize = size
+		}
+		p += size + size%2
+	}
+	switch {
+	case rate == 0 || channels == 0 || bits == 0:
+		return errgo.New("no fmt chunk")
+	case dataSize < 0:
+		return errgo.New("no data chunk")
+	case rec.SampleRate != 0 && (rate != rec.SampleRate || channels != rec.Channels || bits != rec.BitDepth):
+		return errgo.Newf("format is %v Hz %v channels %v bits, recorded as %v Hz %v channels %v bits",
+			rate, channels, bits, rec.SampleRate, rec.Channels, rec.BitDepth)
+	}
+	d := float64(dataSize) / float64(rate*channels*bits/8)
+	if rec.Duration != 0 && math.Abs(d-rec.Duration) > 0.01 {
+		return errgo.Newf("duration is %.3fs, recorded as %.3fs", d, rec.Duration)
+	}
+	return nil
+}
+
+func (r verifyReport) print(checked int) {
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"missing", r.missing},
+		{"corrupt", r.corrupt},
+		{"orphans", r.orphans},
+		{"inconsistencies", r.inconsistent},
+		{"not fully checked", r.unchecked},
+	}
+	for _, s := range sections {
+		if len(s.lines) == 0 {
+			continue
+		}
+		sort.Strings(s.lines)
+		fmt.Printf("%v (%v):\n", s.title, len(s.lines))
+		for _, l := range s.lines {
+			fmt.Println("  " + l)
+		}
+	}
+	fmt.Printf("%v recordings checked, %v missing, %v corrupt, %v orphans, %v inconsistencies, %v not fully checked\n",
+		checked, len(r.missing), len(r.corrupt), len(r.orphans), len(r.inconsistent), len(r.unchecked))
+}